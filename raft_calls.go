@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// RPCStats counts what became of the RPCs a node sent to its peers with one method.
+type RPCStats struct {
+	Sent      int // Every call made
+	Answered  int // Replied to, whatever the reply said
+	Failed    int // The peer could not be reached, or the connection to it closed
+	TimedOut  int // Not replied to within the call's deadline
+	Cancelled int // Given up on because this node changed state or was killed
+}
+
+// RPCStats returns, for each method this node has called on its peers, what became of the calls.
+func (this *RaftNode) RPCStats() map[string]RPCStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	stats := make(map[string]RPCStats, len(this.rpcStats))
+	for method, methodStats := range this.rpcStats {
+		stats[method] = *methodStats
+	}
+	return stats
+}
+
+/* setState moves this node into state in term. If either changes, it gives up on the RPCs it sent
+before; a follower that only hears from its leader again keeps its reads and forwarded commands
+going. Called with this.mu held. */
+func (this *RaftNode) setState(state string, term int) {
+	if state == this.state && term == this.currentTerm {
+		return
+	}
+	this.state = state
+	this.currentTerm = term
+	this.cancelState()
+	this.stateCtx, this.cancelState = context.WithCancel(context.Background())
+}
+
+/* call sends serviceMethod to peerId and waits for the reply, for no longer than the method's
+rpcTimeout, and only as long as ctx, the stateCtx the request was made in, is not cancelled.
+A hung peer therefore never holds on to the goroutine that called it. Called without this.mu. */
+func (this *RaftNode) call(ctx context.Context, peerId int, serviceMethod string, args interface{}, reply interface{}) error {
+	timeout := this.cfg.rpcTimeout(serviceMethod)
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := this.transport.Call(callCtx, peerId, serviceMethod, args, reply)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	method := strings.TrimPrefix(serviceMethod, "RaftNode.")
+	stats := this.rpcStats[method]
+	if stats == nil {
+		stats = new(RPCStats)
+		this.rpcStats[method] = stats
+	}
+	stats.Sent++
+	switch {
+	case err == nil:
+		stats.Answered++
+	case errors.Is(err, context.DeadlineExceeded):
+		stats.TimedOut++
+		this.write_log("%s to %d timed out after %v", method, peerId, timeout)
+	case errors.Is(err, context.Canceled):
+		stats.Cancelled++
+	default:
+		stats.Failed++
+	}
+	return err
+}
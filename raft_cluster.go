@@ -3,6 +3,9 @@ package raft
 import (
 	"log"
 	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -22,24 +25,70 @@ type Cluster struct {
 	// Maintains whether server is partioned or not
 	connected []bool
 
+	// Stable storage of each server, kept across restarts
+	persisters []Persister
+
+	// Maintains whether server is running or crashed
+	alive []bool
+
+	// Everything each server has delivered on its apply channel since it last started
+	applied [][]ApplyMsg
+
 	n int
 
+	// Settings every server is started with, and where each one gets its transport
+	config       Config
+	newTransport func(id int) Transport
+
+	// The faults of the links between servers, which every transport is wrapped in
+	faults *FaultNetwork
+
 	t *testing.T
 }
 
+// testNetworkFaults are the faults of the simulated network the tests were written against.
+func testNetworkFaults() LinkFaults {
+	return LinkFaults{MinDelay: 20 * time.Millisecond, MaxDelay: 520 * time.Millisecond}
+}
+
 func NewCluster(t *testing.T, n int) *Cluster {
+	return NewClusterWithConfig(t, n, DefaultConfig())
+}
+
+// NewClusterWithConfig is NewCluster with servers that run with config.
+func NewClusterWithConfig(t *testing.T, n int, config Config) *Cluster {
+	network := NewMemoryNetwork()
+	return NewClusterWithTransport(t, n, config, func() Transport { return network.NewTransport() })
+}
+
+/* NewClusterWithTransport is NewClusterWithConfig with servers that talk over transports from
+newTransport. Every link starts out with testNetworkFaults, drawn from a seed that is logged;
+set RAFT_NETWORK_SEED to it to have the network make the same fault decisions again. Goroutine
+scheduling and election timeouts are not seeded, so the run as a whole can still differ. */
+func NewClusterWithTransport(t *testing.T, n int, config Config, newTransport func() Transport) *Cluster {
+	seed := time.Now().UnixNano()
+	if env := os.Getenv("RAFT_NETWORK_SEED"); env != "" {
+		var err error
+		if seed, err = strconv.ParseInt(env, 10, 64); err != nil {
+			t.Fatalf("RAFT_NETWORK_SEED=%q is not a number: %v", env, err)
+		}
+	}
+	testing_log("Network seed is %d", seed)
+	faults := NewFaultNetwork(seed)
+	faults.SetAll(testNetworkFaults())
+	newFaultyTransport := func(id int) Transport { return faults.Wrap(id, newTransport()) }
+
 	ns := make([]*Server, n)
 	connected := make([]bool, n)
+	persisters := make([]Persister, n)
+	alive := make([]bool, n)
+	applied := make([][]ApplyMsg, n)
+	applyChs := make([]chan ApplyMsg, n)
 	ready := make(chan interface{})
 
 	// Create all Servers in this nodes, assign ids and peer ids.
 	for i := 0; i < n; i++ {
-		peersIds := make([]int, 0)
-		for p := 0; p < n; p++ {
-			if p != i {
-				peersIds = append(peersIds, p)
-			}
-		}
+		peersIds := clusterPeersIds(i, n)
 
 		// if i == 2 {
 		// 	ns[i] = NewServer(i, peersIds, ready, 100)
@@ -47,8 +96,14 @@ func NewCluster(t *testing.T, n int) *Cluster {
 		// 	ns[i] = NewServer(i, peersIds, ready, 20)
 		// }
 
-		ns[i] = NewServer(i, peersIds, ready, 20)
+		persisters[i] = NewMemoryPersister()
+		applyChs[i] = make(chan ApplyMsg)
+		var err error
+		if ns[i], err = NewServer(i, peersIds, ready, config, newFaultyTransport(i), persisters[i], newNodeLogsStateMachine(i), applyChs[i]); err != nil {
+			t.Fatal(err)
+		}
 		ns[i].Serve()
+		alive[i] = true
 	}
 
 	// Connect all peers to each other.
@@ -63,22 +118,114 @@ func NewCluster(t *testing.T, n int) *Cluster {
 	close(ready) // Channel!
 
 	this := &Cluster{
-		nodes:     ns,
-		connected: connected,
-		n:         n,
-		t:         t,
+		nodes:        ns,
+		connected:    connected,
+		persisters:   persisters,
+		alive:        alive,
+		applied:      applied,
+		n:            n,
+		config:       config,
+		newTransport: newFaultyTransport,
+		faults:       faults,
+		t:            t,
+	}
+	for i := 0; i < n; i++ {
+		go this.collectApplyMsgs(i, applyChs[i])
 	}
 	return this
 }
 
+// clusterPeersIds returns the ids of every server in an n server nodes except id.
+func clusterPeersIds(id int, n int) []int {
+	peersIds := make([]int, 0)
+	for p := 0; p < n; p++ {
+		if p != id {
+			peersIds = append(peersIds, p)
+		}
+	}
+	return peersIds
+}
+
+// newNodeLogsStateMachine writes what a server applies to NodeLogs/<id>, to observe as output.
+func newNodeLogsStateMachine(id int) StateMachine {
+	return NewFileStateMachine("NodeLogs/" + strconv.Itoa(id))
+}
+
 func (this *Cluster) Shutdown() {
 	for i := 0; i < this.n; i++ {
 		this.nodes[i].DisconnectAll()
 		this.connected[i] = false
 	}
 	for i := 0; i < this.n; i++ {
-		this.nodes[i].Shutdown()
+		if this.alive[i] {
+			this.nodes[i].Shutdown()
+		}
+	}
+}
+
+// CrashPeer disconnects a server and shuts it down; only what it persisted survives.
+func (this *Cluster) CrashPeer(id int) {
+	testing_log("Crashing %d", id)
+	this.DisconnectPeer(id)
+	this.nodes[id].Shutdown()
+	this.alive[id] = false
+}
+
+// RestartPeer starts a fresh server on the persisted state of a crashed one and reconnects it.
+func (this *Cluster) RestartPeer(id int) {
+	if this.alive[id] {
+		this.CrashPeer(id)
+	}
+	testing_log("Restarting %d", id)
+
+	ready := make(chan interface{})
+	close(ready)
+
+	applyCh := make(chan ApplyMsg)
+	this.mu.Lock()
+	this.applied[id] = nil
+	this.mu.Unlock()
+	go this.collectApplyMsgs(id, applyCh)
+
+	server, err := NewServer(id, clusterPeersIds(id, this.n), ready, this.config, this.newTransport(id), this.persisters[id], newNodeLogsStateMachine(id), applyCh)
+	if err != nil {
+		this.t.Fatal(err)
 	}
+	this.nodes[id] = server
+	this.nodes[id].Serve()
+	this.alive[id] = true
+
+	this.ReconnectPeer(id)
+}
+
+// AddPeer starts a new server with no configuration and connects it to all connected servers.
+// It only takes part in the cluster once the leader adds it through ChangeConfiguration.
+func (this *Cluster) AddPeer() int {
+	id := this.n
+	testing_log("Adding %d", id)
+
+	ready := make(chan interface{})
+	close(ready)
+
+	applyCh := make(chan ApplyMsg)
+	this.mu.Lock()
+	this.applied = append(this.applied, nil)
+	this.mu.Unlock()
+	go this.collectApplyMsgs(id, applyCh)
+
+	this.persisters = append(this.persisters, NewMemoryPersister())
+	server, err := NewServer(id, nil, ready, this.config, this.newTransport(id), this.persisters[id], newNodeLogsStateMachine(id), applyCh)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	this.nodes = append(this.nodes, server)
+	this.nodes[id].Serve()
+	this.connected = append(this.connected, false)
+	this.alive = append(this.alive, true)
+	this.n++
+
+	this.ReconnectPeer(id)
+	return id
 }
 
 // DisconnectPeer disconnects a server from all other servers in the nodes.
@@ -118,21 +265,81 @@ func (this *Cluster) ReconnectPeer(id int) {
 	this.nodes[id].raftLogic.mu.Unlock()
 }
 
+// SetNetworkFaults gives every link between servers faults, except those given their own with SetLinkFaults.
+func (this *Cluster) SetNetworkFaults(faults LinkFaults) {
+	testing_log("Setting faults of all links to %+v", faults)
+	this.faults.SetAll(faults)
+}
+
+// SetLinkFaults gives the link from server from to server to faults of its own; the link back is left alone.
+func (this *Cluster) SetLinkFaults(from int, to int, faults LinkFaults) {
+	testing_log("Setting faults of link %d -> %d to %+v", from, to, faults)
+	this.faults.SetLink(from, to, faults)
+}
+
+// ClearLinkFaults takes back the faults given with SetLinkFaults.
+func (this *Cluster) ClearLinkFaults() {
+	testing_log("Clearing faults of single links")
+	this.faults.ClearLinks()
+}
+
+/* Partition splits the servers into groups that only reach each other, healing any partition or
+cut before; a server in none of the groups is on its own. Unlike DisconnectPeer, every server stays
+connected as far as it can tell: messages sent across the split are lost, not refused. */
+func (this *Cluster) Partition(groups ...[]int) {
+	testing_log("Partitioning into %v", groups)
+	this.faults.HealAll()
+	group := make(map[int]int)
+	for g, ids := range groups {
+		for _, id := range ids {
+			group[id] = g + 1
+		}
+	}
+	for i := 0; i < this.n; i++ {
+		for j := 0; j < this.n; j++ {
+			if i != j && (group[i] != group[j] || group[i] == 0) {
+				this.faults.Cut(i, j)
+			}
+		}
+	}
+}
+
+// CutLink stops messages from server from reaching server to; to still reaches from.
+func (this *Cluster) CutLink(from int, to int) {
+	testing_log("Cutting link %d -> %d", from, to)
+	this.faults.Cut(from, to)
+}
+
+// Heal undoes Partition and CutLink, leaving the servers that are connected reaching each other again.
+func (this *Cluster) Heal() {
+	testing_log("Healing all links")
+	this.faults.HealAll()
+}
+
 /* getClusterLeader checks that only a single server thinks it's the leader.
 Returns the leader's id and term. It retries several times if no leader is
 identified yet. */
 func (this *Cluster) getClusterLeader() int {
+	ids := make([]int, 0)
+	for i := 0; i < this.n; i++ {
+		if this.connected[i] {
+			ids = append(ids, i)
+		}
+	}
+	return this.getGroupLeader(ids)
+}
+
+// getGroupLeader is getClusterLeader among the servers in ids only, such as one side of a Partition.
+func (this *Cluster) getGroupLeader(ids []int) int {
 	for r := 0; r < 20; r++ {
 		leaderId := -1
-		for i := 0; i < this.n; i++ {
-			if this.connected[i] {
-				_, _, isLeader := this.nodes[i].raftLogic.GetNodeState()
-				if isLeader {
-					if leaderId < 0 {
-						leaderId = i
-					} else {
-						this.t.Fatalf("Somehow have more than one leader!!!!!")
-					}
+		for _, i := range ids {
+			_, _, isLeader := this.nodes[i].raftLogic.GetNodeState()
+			if isLeader {
+				if leaderId < 0 {
+					leaderId = i
+				} else {
+					this.t.Fatalf("Somehow have more than one leader!!!!!")
 				}
 			}
 		}
@@ -146,11 +353,65 @@ func (this *Cluster) getClusterLeader() int {
 	return -1
 }
 
+// collectApplyMsgs records everything a server delivers on applyCh, until the server is killed and closes it.
+func (this *Cluster) collectApplyMsgs(id int, applyCh <-chan ApplyMsg) {
+	for msg := range applyCh {
+		this.mu.Lock()
+		this.applied[id] = append(this.applied[id], msg)
+		this.mu.Unlock()
+	}
+}
+
+// getAppliedCommands returns the commands serverId has delivered on its apply channel, in order.
+func (this *Cluster) getAppliedCommands(serverId int) []interface{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	commands := make([]interface{}, 0)
+	for _, msg := range this.applied[serverId] {
+		if msg.CommandValid {
+			commands = append(commands, msg.Command)
+		}
+	}
+	return commands
+}
+
+// waitForAppliedCommands waits up to timeoutMs until serverId has applied exactly want, and returns what it has applied.
+func (this *Cluster) waitForAppliedCommands(serverId int, want []interface{}, timeoutMs int) []interface{} {
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		applied := this.getAppliedCommands(serverId)
+		if reflect.DeepEqual(applied, want) || time.Now().After(deadline) {
+			return applied
+		}
+		sleepMs(250)
+	}
+}
+
+// waitForConfiguration waits until serverId has committed a configuration of exactly voters.
+func (this *Cluster) waitForConfiguration(serverId int, voters []int) {
+	for r := 0; r < 40; r++ {
+		config, committed := this.nodes[serverId].raftLogic.GetConfiguration()
+		if committed && !config.isJoint() && reflect.DeepEqual(config.Voters, voters) {
+			return
+		}
+		sleepMs(250)
+	}
+
+	config, committed := this.nodes[serverId].raftLogic.GetConfiguration()
+	this.t.Fatalf("node %d has configuration %+v (committed=%v); want voters %v", serverId, config, committed, voters)
+}
+
 // SubmitClientCommand submits the command to serverId.
 func (this *Cluster) SubmitClientCommand(serverId int, cmd interface{}) bool {
 	return this.nodes[serverId].raftLogic.ReceiveClientCommand(cmd)
 }
 
+// SubmitClientRequest submits the command that clientId numbered sequence to serverId.
+func (this *Cluster) SubmitClientRequest(serverId int, clientId int64, sequence int64, cmd interface{}) bool {
+	return this.nodes[serverId].raftLogic.ReceiveClientRequest(clientId, sequence, cmd)
+}
+
 func testing_log(format string, a ...interface{}) {
 	format = "[ACTION] " + format
 	log.Printf(format, a...)
@@ -0,0 +1,103 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/* Config holds the timing and behaviour settings of a Server and its RaftNode. Start from
+DefaultConfig and change what you need; NewServer refuses a Config that does not Validate. */
+type Config struct {
+	// A follower that hears from no leader for a timeout drawn from [ElectionTimeoutMin,
+	// ElectionTimeoutMax) starts an election. ElectionTimeoutMin is also how long a leader may go
+	// without hearing from a quorum (CheckQuorum), how long a follower stands by a leader it heard
+	// from (PreVote), and bounds the leader lease.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	HeartbeatInterval time.Duration // How often a leader sends every peer an AppendEntries, empty or not
+	TickInterval      time.Duration // How often election timers and leadership transfers check on progress
+
+	MaxInflightAppends  int // AppendEntries a leader may have outstanding to each peer at once
+	MaxEntriesPerAppend int // Entries a leader sends in a single AppendEntries
+	MaxBytesPerAppend   int // Bytes of commands a leader sends in a single AppendEntries
+
+	SnapshotThreshold int           // Take a snapshot once this many applied entries are in the log; 0 never does
+	MaxClockDrift     time.Duration // How far apart two servers' clocks may drift over an election timeout
+	ForwardProposals  bool          // SubmitCommand on a follower forwards the command to the leader
+	ProposalTimeout   time.Duration // How long SubmitCommand waits on the leader for its command to be applied
+
+	Logging         bool // Log at all
+	LogHeartbeats   bool // Also log empty AppendEntries and their replies
+	LogVoteRequests bool // Also log PreVote and RequestVote traffic
+}
+
+// DefaultConfig returns the settings the cluster was originally tuned for.
+func DefaultConfig() Config {
+	return Config{
+		ElectionTimeoutMin: 3000 * time.Millisecond,
+		ElectionTimeoutMax: 6000 * time.Millisecond,
+
+		HeartbeatInterval: 1000 * time.Millisecond,
+		TickInterval:      200 * time.Millisecond,
+
+		MaxInflightAppends:  4,
+		MaxEntriesPerAppend: 64,
+		MaxBytesPerAppend:   64 * 1024,
+
+		MaxClockDrift:   300 * time.Millisecond,
+		ProposalTimeout: 6000 * time.Millisecond,
+
+		Logging:         true,
+		LogHeartbeats:   false,
+		LogVoteRequests: true,
+	}
+}
+
+// Validate reports the first setting that is out of range, or would stop the cluster from working.
+func (this Config) Validate() error {
+	switch {
+	case this.ElectionTimeoutMin <= 0:
+		return fmt.Errorf("raft: ElectionTimeoutMin must be positive, not %v", this.ElectionTimeoutMin)
+	case this.ElectionTimeoutMax <= this.ElectionTimeoutMin:
+		return fmt.Errorf("raft: ElectionTimeoutMax (%v) must be above ElectionTimeoutMin (%v)", this.ElectionTimeoutMax, this.ElectionTimeoutMin)
+	case this.HeartbeatInterval <= 0 || this.HeartbeatInterval >= this.ElectionTimeoutMin:
+		return fmt.Errorf("raft: HeartbeatInterval (%v) must be positive and below ElectionTimeoutMin (%v)", this.HeartbeatInterval, this.ElectionTimeoutMin)
+	case this.TickInterval <= 0 || this.TickInterval >= this.ElectionTimeoutMin:
+		return fmt.Errorf("raft: TickInterval (%v) must be positive and below ElectionTimeoutMin (%v)", this.TickInterval, this.ElectionTimeoutMin)
+	case this.MaxInflightAppends < 1 || this.MaxEntriesPerAppend < 1 || this.MaxBytesPerAppend < 1:
+		return fmt.Errorf("raft: MaxInflightAppends (%d), MaxEntriesPerAppend (%d) and MaxBytesPerAppend (%d) must be at least 1",
+			this.MaxInflightAppends, this.MaxEntriesPerAppend, this.MaxBytesPerAppend)
+	case this.SnapshotThreshold < 0:
+		return fmt.Errorf("raft: SnapshotThreshold cannot be negative, not %d", this.SnapshotThreshold)
+	case this.MaxClockDrift < 0 || this.MaxClockDrift >= this.ElectionTimeoutMin:
+		return fmt.Errorf("raft: MaxClockDrift (%v) must be below ElectionTimeoutMin (%v)", this.MaxClockDrift, this.ElectionTimeoutMin)
+	case this.ProposalTimeout <= 0:
+		return fmt.Errorf("raft: ProposalTimeout must be positive, not %v", this.ProposalTimeout)
+	}
+	return nil
+}
+
+// randomElectionTimeout draws an election timeout from [ElectionTimeoutMin, ElectionTimeoutMax).
+func (this Config) randomElectionTimeout() time.Duration {
+	return this.ElectionTimeoutMin + time.Duration(rand.Int63n(int64(this.ElectionTimeoutMax-this.ElectionTimeoutMin)))
+}
+
+/* rpcTimeout is how long a node waits for the reply to an RPC to a peer before it gives up on it.
+A vote, TimeoutNow or snapshot answered after an election timeout is of no more use, since the
+election or transfer has moved on by then; an AppendEntries is sent again once the heartbeat after
+next is due. Client requests relayed to the leader get as long as the leader itself takes to
+answer them, ProposalTimeout for commands, plus an election timeout for the trip. */
+func (this Config) rpcTimeout(serviceMethod string) time.Duration {
+	switch serviceMethod {
+	case "RaftNode.AppendEntries":
+		return 2 * this.HeartbeatInterval
+	case "RaftNode.ReadIndex":
+		return 2 * this.ElectionTimeoutMin
+	case "RaftNode.ForwardCommand":
+		return this.ProposalTimeout + this.ElectionTimeoutMin
+	default:
+		return this.ElectionTimeoutMin
+	}
+}
@@ -0,0 +1,239 @@
+package raft
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrConfigurationChangeInProgress = errors.New("raft: a configuration change is already in progress")
+
+func init() {
+	// Configurations travel inside LogEntry.Command
+	gob.Register(Configuration{})
+}
+
+// Configuration is the set of servers that make up the cluster. While a membership change is
+// under way it is the joint configuration C_old,new: elections and commitment then need
+// separate majorities of both Voters (C_new) and OldVoters (C_old).
+// Learners are sent the log and apply it, but never vote and never count toward a quorum.
+type Configuration struct {
+	Voters    []int
+	OldVoters []int // Only set in a joint configuration
+	Learners  []int
+}
+
+func (this Configuration) isJoint() bool {
+	return len(this.OldVoters) > 0
+}
+
+// isVoter reports whether id has a say in either half of the configuration.
+func (this Configuration) isVoter(id int) bool {
+	return containsId(this.Voters, id) || containsId(this.OldVoters, id)
+}
+
+// isLearner reports whether id is a learner that does not also have a say in the configuration.
+func (this Configuration) isLearner(id int) bool {
+	return containsId(this.Learners, id) && !this.isVoter(id)
+}
+
+// members returns every server in the configuration, learners included, sorted.
+func (this Configuration) members() []int {
+	members := append([]int(nil), this.Voters...)
+	for _, id := range append(append([]int(nil), this.OldVoters...), this.Learners...) {
+		if !containsId(members, id) {
+			members = append(members, id)
+		}
+	}
+	sort.Ints(members)
+	return members
+}
+
+// hasQuorum reports whether the servers in granted form a majority of Voters and, if joint, of OldVoters.
+func (this Configuration) hasQuorum(granted map[int]bool) bool {
+	if !isMajority(this.Voters, granted) {
+		return false
+	}
+	return !this.isJoint() || isMajority(this.OldVoters, granted)
+}
+
+func isMajority(voters []int, granted map[int]bool) bool {
+	count := 0
+	for _, id := range voters {
+		if granted[id] {
+			count++
+		}
+	}
+	return count > len(voters)/2
+}
+
+func containsId(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+/* ChangeConfiguration moves the cluster to a new set of voters using joint consensus. The leader
+appends C_old,new; once that commits it appends C_new by itself. Servers being added must already
+be reachable through the Server; learners listed in voters are promoted. Only one change may be
+in flight at a time, and none while leadership is being transferred. voters must be non-empty and
+free of duplicates, since a configuration that can never form a majority could not be replaced. */
+func (this *RaftNode) ChangeConfiguration(voters []int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.state != "Leader" {
+		return this.notLeader()
+	}
+	if this.config.isJoint() || this.configIndex > this.commitIndex {
+		return ErrConfigurationChangeInProgress
+	}
+	if this.leadTransferee != -1 {
+		return ErrTransferInProgress
+	}
+	if len(voters) == 0 {
+		return errors.New("raft: a configuration needs at least one voter")
+	}
+	for i, id := range voters {
+		if containsId(voters[:i], id) {
+			return fmt.Errorf("raft: voter %d is listed more than once", id)
+		}
+	}
+
+	joint := Configuration{
+		Voters:    append([]int(nil), voters...),
+		OldVoters: append([]int(nil), this.config.Voters...),
+	}
+	for _, id := range this.config.Learners {
+		if !containsId(voters, id) {
+			joint.Learners = append(joint.Learners, id)
+		}
+	}
+	this.appendConfiguration(joint)
+	return nil
+}
+
+/* AddLearner adds id to the cluster as a learner, to bring it up to date before it can affect
+availability. Quorums do not change, so this takes a single configuration entry rather than
+joint consensus. Promote it later by including it in the voters passed to ChangeConfiguration. */
+func (this *RaftNode) AddLearner(id int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.state != "Leader" {
+		return this.notLeader()
+	}
+	if this.config.isJoint() || this.configIndex > this.commitIndex {
+		return ErrConfigurationChangeInProgress
+	}
+	if containsId(this.config.members(), id) {
+		return nil
+	}
+
+	config := Configuration{
+		Voters:   append([]int(nil), this.config.Voters...),
+		Learners: append(append([]int(nil), this.config.Learners...), id),
+	}
+	this.appendConfiguration(config)
+	return nil
+}
+
+// GetConfiguration reports the latest configuration in this node's log, and whether it has committed.
+func (this *RaftNode) GetConfiguration() (config Configuration, committed bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.config, this.configIndex <= this.commitIndex
+}
+
+// appendConfiguration appends a configuration entry on the leader; it takes effect immediately.
+func (this *RaftNode) appendConfiguration(config Configuration) {
+	this.log = append(this.log, LogEntry{Command: config, Term: this.currentTerm, Type: EntryConfiguration})
+	this.persist()
+	this.refreshConfiguration()
+	this.write_log("appended configuration %+v at index %d", config, this.configIndex)
+
+	// Start tracking any server that just joined
+	for _, peerId := range this.peers() {
+		if _, ok := this.nextIndex[peerId]; !ok {
+			this.nextIndex[peerId] = this.lastIncludedIndex + 1
+			this.matchIndex[peerId] = -1
+			this.lastAck[peerId] = time.Now()
+		}
+	}
+	this.syncReplicators()
+	this.triggerReplication()
+
+	// A configuration with no other voters commits on our own say-so
+	this.advanceCommitIndex()
+}
+
+// refreshConfiguration sets config to the latest configuration entry in the log, which is
+// in effect whether or not it has committed, falling back to the one in the snapshot.
+func (this *RaftNode) refreshConfiguration() {
+	for i := this.lastLogIndex(); i > this.lastIncludedIndex; i-- {
+		entry := this.logSlice(i, i+1)[0]
+		if entry.Type == EntryConfiguration {
+			this.config = entry.Command.(Configuration)
+			this.configIndex = i
+			return
+		}
+	}
+	this.config = this.lastIncludedConfig
+	this.configIndex = this.lastIncludedIndex
+}
+
+// configurationAt returns the configuration in effect at index, which must not be before lastIncludedIndex.
+func (this *RaftNode) configurationAt(index int) Configuration {
+	for i := index; i > this.lastIncludedIndex; i-- {
+		entry := this.logSlice(i, i+1)[0]
+		if entry.Type == EntryConfiguration {
+			return entry.Command.(Configuration)
+		}
+	}
+	return this.lastIncludedConfig
+}
+
+// peers returns every other member of the current configuration, the servers a leader replicates to.
+func (this *RaftNode) peers() []int {
+	peers := make([]int, 0)
+	for _, id := range this.config.members() {
+		if id != this.id {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// votingPeers returns the peers whose votes count, the servers a candidate asks for one.
+func (this *RaftNode) votingPeers() []int {
+	peers := make([]int, 0)
+	for _, id := range this.peers() {
+		if this.config.isVoter(id) {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// advanceConfiguration is run by the leader whenever commitIndex moves. Once C_old,new commits
+// it appends C_new, and once C_new commits a leader that is no longer a voter steps down.
+func (this *RaftNode) advanceConfiguration() {
+	if this.state != "Leader" || this.configIndex > this.commitIndex {
+		return
+	}
+
+	if this.config.isJoint() {
+		this.appendConfiguration(Configuration{
+			Voters:   append([]int(nil), this.config.Voters...),
+			Learners: append([]int(nil), this.config.Learners...),
+		})
+	} else if !this.config.isVoter(this.id) {
+		this.write_log("removed from the configuration; stepping down")
+		this.becomeFollower(this.currentTerm)
+	}
+}
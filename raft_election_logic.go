@@ -1,7 +1,6 @@
 package raft
 
 import (
-	"math/rand"
 	"time"
 )
 
@@ -9,14 +8,14 @@ import (
 we want to start a timer towards becoming a candidate in a new election.
 This function runs as a go routine */
 func (this *RaftNode) startElectionTimer() {
-	timeoutDuration := time.Duration(3000+rand.Intn(3000)) * time.Millisecond
+	timeoutDuration := this.cfg.randomElectionTimeout()
 	this.mu.Lock()
 	termStarted := this.currentTerm
 	this.mu.Unlock()
 	this.write_log("Election timer started: %v, with term=%d", timeoutDuration, termStarted)
 
 	// Keep checking for a resolution
-	ticker := time.NewTicker(200 * time.Millisecond)
+	ticker := time.NewTicker(this.cfg.TickInterval)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
@@ -24,7 +23,7 @@ func (this *RaftNode) startElectionTimer() {
 		this.mu.Lock()
 
 		// if node has become a leader
-		if this.state != "Candidate" && this.state != "Follower" {
+		if this.state != "Candidate" && this.state != "PreCandidate" && this.state != "Follower" {
 			this.mu.Unlock()
 			return
 		}
@@ -37,7 +36,13 @@ func (this *RaftNode) startElectionTimer() {
 
 		// Start an election if we haven't heard from a leader or haven't voted for someone for the duration of the timeout.
 		if elapsed := time.Since(this.lastElectionTimerStartedTime); elapsed >= timeoutDuration {
-			this.startElection()
+			if !this.config.isVoter(this.id) {
+				// Learners, and servers outside the configuration, never campaign
+				this.lastElectionTimerStartedTime = time.Now()
+				this.mu.Unlock()
+				continue
+			}
+			this.startPreVote()
 			this.mu.Unlock()
 			return
 		}
@@ -45,29 +50,93 @@ func (this *RaftNode) startElectionTimer() {
 	}
 }
 
-// startElection starts a new election with this RN as a candidate.
-func (this *RaftNode) startElection() {
-	this.state = "Candidate"
-	this.currentTerm += 1
+/* startPreVote asks every peer whether it would vote for this RN at currentTerm+1, without
+incrementing currentTerm. Only once a majority says yes does a real election start, so a node
+that was partitioned away cannot come back with an inflated term and depose a healthy leader. */
+func (this *RaftNode) startPreVote() {
+	this.setState("PreCandidate", this.currentTerm)
+	termWhenPreVoteRequested := this.currentTerm
+	ctx := this.stateCtx
+	this.lastElectionTimerStartedTime = time.Now()
+	this.write_log("became PreCandidate with term=%d;", termWhenPreVoteRequested)
+
+	votesReceived := map[int]bool{this.id: true}
+	if this.config.hasQuorum(votesReceived) {
+		this.startElection(false)
+		return
+	}
+
+	// Send PreVote RPCs to all other servers concurrently.
+	for _, peerId := range this.votingPeers() {
+		go func(peerId int) {
+			this.mu.Lock()
+			LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested := this.lastLogIndex(), this.lastLogTerm()
+			this.mu.Unlock()
+
+			args := PreVoteArgs{
+				Term:         termWhenPreVoteRequested + 1,
+				CandidateId:  this.id,
+				LastLogIndex: LastLogIndexWhenVoteRequested,
+				LastLogTerm:  LastLogTermWhenVoteRequested,
+			}
+
+			if this.cfg.LogVoteRequests {
+				this.write_log("sending PreVote to %d: %+v", peerId, args)
+			}
+
+			var reply PreVoteReply
+			if err := this.call(ctx, peerId, "RaftNode.PreVote", args, &reply); err == nil {
+				this.mu.Lock()
+				defer this.mu.Unlock()
+				if this.cfg.LogVoteRequests {
+					this.write_log("received PreVoteReply from %d: %+v", peerId, reply)
+				}
+				if this.state != "PreCandidate" || this.currentTerm != termWhenPreVoteRequested {
+					return
+				}
+
+				if reply.Term > termWhenPreVoteRequested {
+					this.becomeFollower(reply.Term)
+					return
+				}
+				if reply.VoteGranted {
+					votesReceived[peerId] = true
+					if this.config.hasQuorum(votesReceived) {
+						this.write_log("WON THE PREVOTE! with %d votes", len(votesReceived))
+						this.startElection(false)
+						return
+					}
+				}
+			}
+		}(peerId)
+	}
+
+	// Run another election timer, in case the pre-vote is not successful.
+	go this.startElectionTimer()
+}
+
+// startElection starts a new election with this RN as a candidate; leadershipTransfer if TimeoutNow told us to.
+func (this *RaftNode) startElection(leadershipTransfer bool) {
+	this.setState("Candidate", this.currentTerm+1)
 	termWhenVoteRequested := this.currentTerm
+	ctx := this.stateCtx
 	this.lastElectionTimerStartedTime = time.Now()
 	this.votedFor = this.id
+	this.persist()
 	this.write_log("became Candidate with term=%d;", termWhenVoteRequested)
 
-	votesReceived := 1
+	votesReceived := map[int]bool{this.id: true}
+	if this.config.hasQuorum(votesReceived) {
+		this.write_log("WON THE ELECTION! as the only voter")
+		this.startLeader()
+		return
+	}
 
 	// Send RequestVote RPCs to all other servers concurrently.
-	for _, peerId := range this.peersIds {
+	for _, peerId := range this.votingPeers() {
 		go func(peerId int) {
 			this.mu.Lock()
-			var LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested int
-
-			if len(this.log) > 0 {
-				lastIndex := len(this.log) - 1
-				LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested = lastIndex, this.log[lastIndex].Term
-			} else {
-				LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested = -1, -1
-			}
+			LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested := this.lastLogIndex(), this.lastLogTerm()
 			this.mu.Unlock()
 
 			args := RequestVoteArgs{
@@ -76,18 +145,18 @@ func (this *RaftNode) startElection() {
 				LastLogIndex: LastLogIndexWhenVoteRequested,
 				LastLogTerm:  LastLogTermWhenVoteRequested,
 
-				Latency: rand.Intn(500),
+				LeadershipTransfer: leadershipTransfer,
 			}
 
-			if VoteRequestLogs {
+			if this.cfg.LogVoteRequests {
 				this.write_log("sending RequestVote to %d: %+v", peerId, args)
 			}
 
 			var reply RequestVoteReply
-			if err := this.server.SendRPCCallTo(peerId, "RaftNode.RequestVote", args, &reply); err == nil {
+			if err := this.call(ctx, peerId, "RaftNode.RequestVote", args, &reply); err == nil {
 				this.mu.Lock()
 				defer this.mu.Unlock()
-				if VoteRequestLogs {
+				if this.cfg.LogVoteRequests {
 					this.write_log("received RequestVoteReply from %d: %+v", peerId, reply)
 				}
 				if this.state != "Candidate" {
@@ -100,9 +169,9 @@ func (this *RaftNode) startElection() {
 					return
 				} else if reply.Term == termWhenVoteRequested {
 					if reply.VoteGranted {
-						votesReceived += 1
-						if votesReceived > (len(this.peersIds)+1)/2 {
-							this.write_log("WON THE ELECTION! with %d votes", votesReceived)
+						votesReceived[peerId] = true
+						if this.config.hasQuorum(votesReceived) {
+							this.write_log("WON THE ELECTION! with %d votes", len(votesReceived))
 							this.startLeader()
 							return
 						}
@@ -117,11 +186,16 @@ func (this *RaftNode) startElection() {
 }
 
 // becomeFollower sets a node to be a follower and resets its state.
+// A vote is only forgotten when moving to a new term; within a term it must stand.
 func (this *RaftNode) becomeFollower(term int) {
 	this.write_log("became Follower with term=%d; log=%v", term, this.log)
-	this.state = "Follower"
-	this.currentTerm = term
-	this.votedFor = -1
+	if term > this.currentTerm {
+		this.votedFor = -1
+	}
+	this.setState("Follower", term)
+	this.leaderId = -1 // Until we hear from the leader of this term
+	this.stopReplicators()
+	this.persist()
 	this.lastElectionTimerStartedTime = time.Now()
 
 	go this.startElectionTimer()
@@ -0,0 +1,190 @@
+package raft
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/* Fault injection, to put servers on a network that misbehaves the way a real one does.
+A FaultNetwork wraps the Transport of each server in a FaultyTransport, which makes the RPCs it
+sends suffer the faults set for their link, from the sending server to the receiving one. All
+fault decisions are drawn from one seeded source, so the same seed makes the same decisions again;
+scheduling and timers are not seeded, so that alone does not replay a run.
+A link can also be cut in one direction, which loses every message that would cross it that way:
+the requests its sender makes, and the replies to the requests its receiver makes. */
+
+// LinkFaults are the faults each RPC sent over a link suffers. The zero value is a perfect link.
+type LinkFaults struct {
+	// Each request is held up for a delay drawn from [MinDelay, MaxDelay] before it is delivered
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	DropRate      float64 // Chance the request, and separately its reply, is lost; the call then waits out its ctx
+	DuplicateRate float64 // Chance the request is delivered a second time, after another delay
+	ReorderRate   float64 // Chance the request is held back an extra MaxDelay, so requests sent after it overtake it
+}
+
+type FaultNetwork struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	seed  int64
+	all   LinkFaults
+	links map[[2]int]LinkFaults // Overrides all for the links set with SetLink, by [from, to]
+	cut   map[[2]int]bool       // Links that carry nothing from the first server to the second
+}
+
+// NewFaultNetwork returns a network with perfect links whose faults are drawn from seed.
+func NewFaultNetwork(seed int64) *FaultNetwork {
+	this := new(FaultNetwork)
+	this.rand = rand.New(rand.NewSource(seed))
+	this.seed = seed
+	this.links = make(map[[2]int]LinkFaults)
+	this.cut = make(map[[2]int]bool)
+	return this
+}
+
+// Seed is what the network was created with, to make the same fault decisions again.
+func (this *FaultNetwork) Seed() int64 {
+	return this.seed
+}
+
+// SetAll sets the faults of every link that has none set of its own.
+func (this *FaultNetwork) SetAll(faults LinkFaults) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.all = faults
+}
+
+// SetLink sets the faults of the RPCs server from sends to server to, but not of those it receives from it.
+func (this *FaultNetwork) SetLink(from int, to int, faults LinkFaults) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.links[[2]int{from, to}] = faults
+}
+
+// ClearLinks forgets the faults set with SetLink, leaving every link with those set with SetAll.
+func (this *FaultNetwork) ClearLinks() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.links = make(map[[2]int]LinkFaults)
+}
+
+// Cut stops messages from server from reaching server to, while those from to still reach from.
+func (this *FaultNetwork) Cut(from int, to int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.cut[[2]int{from, to}] = true
+}
+
+// HealAll restores every link that was Cut.
+func (this *FaultNetwork) HealAll() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.cut = make(map[[2]int]bool)
+}
+
+func (this *FaultNetwork) isCut(from int, to int) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.cut[[2]int{from, to}]
+}
+
+// Wrap returns transport, as used by server id, with the faults of this network.
+func (this *FaultNetwork) Wrap(id int, transport Transport) *FaultyTransport {
+	return &FaultyTransport{Transport: transport, network: this, id: id}
+}
+
+// rpcFate is what befalls one RPC over a link, drawn all at once so every RPC takes the same draws from the seed.
+type rpcFate struct {
+	delay          time.Duration
+	dropRequest    bool
+	dropReply      bool
+	duplicate      bool
+	duplicateDelay time.Duration
+}
+
+func (this *FaultNetwork) drawFate(from int, to int) rpcFate {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	faults, found := this.links[[2]int{from, to}]
+	if !found {
+		faults = this.all
+	}
+
+	var fate rpcFate
+	fate.delay = this.drawDelay(faults)
+	if this.rand.Float64() < faults.ReorderRate {
+		fate.delay += faults.MaxDelay
+	}
+	fate.dropRequest = this.rand.Float64() < faults.DropRate
+	fate.dropReply = this.rand.Float64() < faults.DropRate
+	if fate.duplicate = this.rand.Float64() < faults.DuplicateRate; fate.duplicate {
+		fate.duplicateDelay = this.drawDelay(faults)
+	}
+	return fate
+}
+
+// drawDelay draws a delay from [MinDelay, MaxDelay]. Called with this.mu held.
+func (this *FaultNetwork) drawDelay(faults LinkFaults) time.Duration {
+	if faults.MaxDelay <= faults.MinDelay {
+		return faults.MinDelay
+	}
+	return faults.MinDelay + time.Duration(this.rand.Int63n(int64(faults.MaxDelay-faults.MinDelay)+1))
+}
+
+// A FaultyTransport is a Transport whose Calls suffer the faults of its FaultNetwork.
+type FaultyTransport struct {
+	Transport
+	network *FaultNetwork
+	id      int
+}
+
+func (this *FaultyTransport) Call(ctx context.Context, peerId int, serviceMethod string, args interface{}, reply interface{}) error {
+	fate := this.network.drawFate(this.id, peerId)
+
+	if fate.duplicate {
+		// The copy is answered into a reply of its own, which nobody looks at,
+		duplicateReply := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		// and which lives on after the original returns, for as long as the original would have
+		duplicateCtx, cancel := context.WithCancel(context.Background())
+		if deadline, ok := ctx.Deadline(); ok {
+			cancel()
+			duplicateCtx, cancel = context.WithDeadline(context.Background(), deadline.Add(fate.duplicateDelay))
+		}
+		go func() {
+			defer cancel()
+			if sleepCtx(duplicateCtx, fate.delay+fate.duplicateDelay) == nil && !this.network.isCut(this.id, peerId) {
+				this.Transport.Call(duplicateCtx, peerId, serviceMethod, args, duplicateReply)
+			}
+		}()
+	}
+
+	if err := sleepCtx(ctx, fate.delay); err != nil {
+		return err
+	}
+	if fate.dropRequest || this.network.isCut(this.id, peerId) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err := this.Transport.Call(ctx, peerId, serviceMethod, args, reply)
+	if err == nil && (fate.dropReply || this.network.isCut(peerId, this.id)) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return err
+}
+
+// sleepCtx waits for d, or returns ctx.Err() if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
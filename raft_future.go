@@ -0,0 +1,82 @@
+package raft
+
+import "errors"
+
+var ErrEntryOverwritten = errors.New("raft: entry was overwritten by another leader's log before it committed")
+var ErrResultUnknown = errors.New("raft: entry was committed inside a snapshot from the leader, which may or may not have applied it")
+var ErrNodeKilled = errors.New("raft: node was killed before the entry was applied")
+
+// CommitFuture resolves once the entry a proposal was appended at is applied,
+// with the state machine's result, or once it is known it never will be.
+// ErrResultUnknown means neither: a snapshot from the leader covered the entry before this node
+// applied it, so the proposal may have been applied there. Retry it only within a client session.
+type CommitFuture struct {
+	index int
+	term  int
+
+	done   chan interface{}
+	result interface{}
+	err    error
+}
+
+func newCommitFuture(index int, term int) *CommitFuture {
+	this := new(CommitFuture)
+	this.index = index
+	this.term = term
+	this.done = make(chan interface{})
+	return this
+}
+
+// Index of the log entry the proposal was appended at.
+func (this *CommitFuture) Index() int {
+	return this.index
+}
+
+// Term of the log entry the proposal was appended at.
+func (this *CommitFuture) Term() int {
+	return this.term
+}
+
+// Done is closed once Result no longer blocks.
+func (this *CommitFuture) Done() <-chan interface{} {
+	return this.done
+}
+
+// Result blocks until the entry is applied, and returns what the state machine returned for it.
+func (this *CommitFuture) Result() (interface{}, error) {
+	<-this.done
+	return this.result, this.err
+}
+
+func (this *CommitFuture) resolve(result interface{}, err error) {
+	this.result = result
+	this.err = err
+	close(this.done)
+}
+
+/* Bookkeeping of the proposals still waiting on their entry, all called with this.mu held */
+
+// resolveProposal settles the proposal waiting on index, now that entry has been applied there.
+func (this *RaftNode) resolveProposal(index int, entry LogEntry, result interface{}) {
+	future, ok := this.pendingProposals[index]
+	if !ok {
+		return
+	}
+	delete(this.pendingProposals, index)
+
+	if future.term == entry.Term {
+		future.resolve(result, nil)
+	} else {
+		future.resolve(nil, ErrEntryOverwritten)
+	}
+}
+
+// failProposals fails every proposal waiting on an entry with an index in [from, to].
+func (this *RaftNode) failProposals(from int, to int, err error) {
+	for proposalIndex, future := range this.pendingProposals {
+		if proposalIndex >= from && proposalIndex <= to {
+			delete(this.pendingProposals, proposalIndex)
+			future.resolve(nil, err)
+		}
+	}
+}
@@ -1,22 +1,56 @@
 package raft
 
 import (
-	"math/rand"
+	"context"
+	"errors"
+	"fmt"
 	"time"
 )
 
+var ErrTransferInProgress = errors.New("raft: a leadership transfer is already in progress")
+var ErrTransferTimeout = errors.New("raft: leadership transfer timed out")
+var ErrTransferFailed = errors.New("raft: leadership went to another node than the transfer target")
+
+// ErrNotLeader is returned by calls that only the leader can serve. LeaderId is the leader of the
+// current term as far as this node knows, -1 if it does not, so the caller can try again there.
+type ErrNotLeader struct {
+	LeaderId int
+}
+
+func (this ErrNotLeader) Error() string {
+	if this.LeaderId == -1 {
+		return "raft: this node is not the leader, and does not know which node is"
+	}
+	return fmt.Sprintf("raft: this node is not the leader, node %d is", this.LeaderId)
+}
+
+// notLeader returns the ErrNotLeader this node answers with, called with this.mu held.
+func (this *RaftNode) notLeader() error {
+	return ErrNotLeader{LeaderId: this.leaderId}
+}
+
 // startLeader switches this into a leader state and begins process of heartbeats.
 func (this *RaftNode) startLeader() {
-	this.state = "Leader"
+	this.setState("Leader", this.currentTerm)
+	this.leaderId = this.id
+	this.leadTransferee = -1
 
-	for _, peerId := range this.peersIds {
-		this.nextIndex[peerId] = len(this.log)
+	for _, peerId := range this.peers() {
+		this.nextIndex[peerId] = this.lastLogIndex() + 1
 		this.matchIndex[peerId] = -1
+		this.lastAck[peerId] = time.Now() // Give every peer a full election timeout to answer us
 	}
 	this.write_log("became Leader; term=%d, nextIndex=%v, matchIndex=%v; log=%v", this.currentTerm, this.nextIndex, this.matchIndex, this.log)
 
+	// Entries from earlier terms can only commit along with one from our term. Append a no-op
+	// so that they do not have to wait for the next client command.
+	this.log = append(this.log, LogEntry{Term: this.currentTerm, Type: EntryNoOp})
+	this.persist()
+	this.syncReplicators()
+	this.advanceCommitIndex()
+
 	go func() {
-		ticker := time.NewTicker(1000 * time.Millisecond)
+		ticker := time.NewTicker(this.cfg.HeartbeatInterval)
 		defer ticker.Stop()
 
 		// Send periodic heartbeats, as long as still leader.
@@ -29,103 +63,235 @@ func (this *RaftNode) startLeader() {
 				this.mu.Unlock()
 				return
 			}
+
+			// CheckQuorum: a leader that cannot reach a majority must stop accepting commands
+			if !this.hasQuorumContact() {
+				this.write_log("lost contact with a quorum; lastAck=%v", this.lastAck)
+				this.becomeFollower(this.currentTerm)
+				this.mu.Unlock()
+				return
+			}
 			this.mu.Unlock()
 		}
 	}()
 }
 
-// broadcastHeartbeats sends a round of heartbeats to all peers, collects their replies and adjusts this's state.
+// hasQuorumContact reports whether a quorum, counting this, has answered us within an election timeout.
+func (this *RaftNode) hasQuorumContact() bool {
+	return this.hasQuorumAckSince(time.Now().Add(-this.cfg.ElectionTimeoutMin))
+}
+
+// hasQuorumAckSince reports whether a quorum, counting this, has answered requests we sent at or after t.
+func (this *RaftNode) hasQuorumAckSince(t time.Time) bool {
+	contacts := map[int]bool{this.id: true}
+	for _, peerId := range this.peers() {
+		if !this.lastAck[peerId].Before(t) {
+			contacts[peerId] = true
+		}
+	}
+	return this.config.hasQuorum(contacts)
+}
+
+// recordAck notes that peerId answered a request we sent at sentAt. Any answer in our term counts,
+// a rejected AppendEntries still acknowledges us as its leader.
+func (this *RaftNode) recordAck(peerId int, sentAt time.Time) {
+	if sentAt.After(this.lastAck[peerId]) {
+		this.lastAck[peerId] = sentAt
+	}
+}
+
+// broadcastHeartbeats has every replicator send its peer a round of AppendEntries, empty if it is up to date.
 func (this *RaftNode) broadcastHeartbeats() {
 	this.mu.Lock()
+	defer this.mu.Unlock()
 
 	if this.state != "Leader" {
-		this.mu.Unlock()
 		return
 	}
-	termWhenHeartbeatSent := this.currentTerm
+	for _, r := range this.replicators {
+		r.heartbeatDue = true
+		r.notify()
+	}
+}
 
-	this.mu.Unlock()
+/* backtrackNextIndex picks the next index to try for a peer that rejected an AppendEntries sent at
+nextIndex. If we have entries of the conflicting term, the peer may share them, so we retry just past
+our last one; otherwise none of the peer's entries of that term can match and we skip all of them. */
+func (this *RaftNode) backtrackNextIndex(nextIndex int, reply AppendEntriesReply) int {
+	newNextIndex := reply.ConflictIndex
+	if reply.ConflictTerm != -1 {
+		for i := this.lastLogIndex(); i > this.lastIncludedIndex; i-- {
+			if this.logTerm(i) == reply.ConflictTerm {
+				newNextIndex = i + 1
+				break
+			}
+		}
+	}
 
-	for _, peerId := range this.peersIds {
+	// Always make progress, and never back up past the start of the log
+	if newNextIndex >= nextIndex {
+		newNextIndex = nextIndex - 1
+	}
+	if newNextIndex < 0 {
+		newNextIndex = 0
+	}
+	return newNextIndex
+}
 
-		go func(peerId int) {
-			this.mu.Lock()
+// advanceCommitIndex commits every entry of our term that a quorum has replicated, along with all before it.
+func (this *RaftNode) advanceCommitIndex() {
+	oldCommitIndex := this.commitIndex
 
-			currentPeer_nextIndex := this.nextIndex[peerId]
-			prevLogIndex := currentPeer_nextIndex - 1
-			prevLogTerm := -1
-			if prevLogIndex >= 0 {
-				prevLogTerm = this.log[prevLogIndex].Term
+	// AppendEntries success on majority, now commit on leader (IF NOT HEARTBEAT)
+	for i := this.commitIndex + 1; i <= this.lastLogIndex(); i++ {
+		if this.logTerm(i) == this.currentTerm {
+			matched := map[int]bool{this.id: true}
+			for _, peerId := range this.peers() {
+				if this.matchIndex[peerId] >= i {
+					matched[peerId] = true
+				}
 			}
-			entries := this.log[currentPeer_nextIndex:]
-
-			var aeType string
-			if len(entries) > 0 {
-				aeType = "AppendEntries"
-			} else {
-				aeType = "Heartbeat"
+			if this.config.hasQuorum(matched) {
+				this.commitIndex = i
 			}
+		}
+	}
+	if this.commitIndex != oldCommitIndex {
+		this.write_log("leader sets commitIndex := %d", this.commitIndex)
+		this.applyCond.Broadcast()
+		this.advanceConfiguration()
+	}
+}
 
-			args := AppendEntriesArgs{
-				Term:         termWhenHeartbeatSent,
-				LeaderId:     this.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: this.commitIndex,
-				Latency:      rand.Intn(500),
-			}
+// sendSnapshot brings a peer whose nextIndex falls behind our snapshot up to date with an InstallSnapshot RPC.
+func (this *RaftNode) sendSnapshot(ctx context.Context, peerId int, termWhenSnapshotSent int) {
+	this.mu.Lock()
+	args := InstallSnapshotArgs{
+		Term:              termWhenSnapshotSent,
+		LeaderId:          this.id,
+		LastIncludedIndex: this.lastIncludedIndex,
+		LastIncludedTerm:  this.lastIncludedTerm,
+		LastConfig:        this.lastIncludedConfig,
+		Sessions:          this.lastIncludedSessions,
+		Data:              this.snapshot,
+	}
+	this.mu.Unlock()
+	this.write_log("sending InstallSnapshot to %v: lastIncludedIndex=%d, lastIncludedTerm=%d", peerId, args.LastIncludedIndex, args.LastIncludedTerm)
 
-			this.mu.Unlock()
-			if (aeType == "Heartbeat" && HeartbeatLogs) || aeType == "AppendEntries" {
-				this.write_log("sending %s to %v: currentPeer_nextIndex=%d, args=%+v", aeType, peerId, currentPeer_nextIndex, args)
+	var reply InstallSnapshotReply
+	sentAt := time.Now()
+	if err := this.call(ctx, peerId, "RaftNode.InstallSnapshot", args, &reply); err == nil {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+
+		if reply.Term > this.currentTerm {
+			this.becomeFollower(reply.Term)
+			return
+		}
+
+		if this.state == "Leader" && termWhenSnapshotSent == reply.Term {
+			this.recordAck(peerId, sentAt)
+			if this.nextIndex[peerId] < args.LastIncludedIndex+1 {
+				this.nextIndex[peerId] = args.LastIncludedIndex + 1
 			}
+			if this.matchIndex[peerId] < args.LastIncludedIndex {
+				this.matchIndex[peerId] = args.LastIncludedIndex
+			}
+			this.write_log("InstallSnapshot reply from NODE %d: nextIndex := %v, matchIndex := %v", peerId, this.nextIndex, this.matchIndex)
+		}
+	}
+}
 
-			var reply AppendEntriesReply
-			if err := this.server.SendRPCCallTo(peerId, "RaftNode.AppendEntries", args, &reply); err == nil {
-				this.mu.Lock()
-				defer this.mu.Unlock()
+/* TransferLeadership hands leadership to targetId, e.g. before taking this node down for maintenance.
+Proposals are refused while the transfer runs. Once the target's log has caught up with ours it is
+sent a TimeoutNow RPC, which makes it start an election straight away. If we have not stepped
+down within an election timeout the transfer is abandoned and we carry on as leader. Once we have
+stepped down, the transfer only succeeds when the next leader we hear from is the target. */
+func (this *RaftNode) TransferLeadership(targetId int) error {
+	this.mu.Lock()
+	if this.state != "Leader" {
+		err := this.notLeader()
+		this.mu.Unlock()
+		return err
+	}
+	if this.leadTransferee != -1 {
+		this.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	if targetId == this.id {
+		this.mu.Unlock()
+		return nil
+	}
+	if !this.config.isVoter(targetId) {
+		this.mu.Unlock()
+		return fmt.Errorf("raft: cannot transfer leadership to %d, it is not a voter", targetId)
+	}
+	this.leadTransferee = targetId
+	termWhenTransferStarted := this.currentTerm
+	ctx := this.stateCtx
+	this.write_log("transferring leadership to %d; matchIndex=%v", targetId, this.matchIndex)
+	this.mu.Unlock()
 
-				if reply.Term > this.currentTerm {
-					this.becomeFollower(reply.Term)
-					return
-				}
+	deadline := time.Now().Add(this.cfg.ElectionTimeoutMin)
+	ticker := time.NewTicker(this.cfg.TickInterval)
+	defer ticker.Stop()
 
-				if this.state == "Leader" && termWhenHeartbeatSent == reply.Term {
-					if reply.Success {
-						this.nextIndex[peerId] = currentPeer_nextIndex + len(entries)
-						this.matchIndex[peerId] = this.nextIndex[peerId] - 1
-						if (aeType == "Heartbeat" && HeartbeatLogs) || aeType == "AppendEntries" {
-							this.write_log("%s reply from NODE %d success: nextIndex := %v, matchIndex := %v", aeType, peerId, this.nextIndex, this.matchIndex)
-						}
-						oldCommitIndex := this.commitIndex
-
-						// AppendEntries success on majority, now commit on leader (IF NOT HEARTBEAT)
-						for i := this.commitIndex + 1; i < len(this.log); i++ {
-							if this.log[i].Term == this.currentTerm {
-								matchCount := 1
-								for _, peerId := range this.peersIds {
-									if this.matchIndex[peerId] >= i {
-										matchCount++
-									}
-								}
-								if matchCount > (len(this.peersIds)+1)/2 {
-									this.commitIndex = i
-								}
-							}
-						}
-						if this.commitIndex != oldCommitIndex {
-							this.write_log("leader sets commitIndex := %d", this.commitIndex)
-							this.notifyToApplyCommit <- 1
-						}
-					} else {
-						this.nextIndex[peerId] = currentPeer_nextIndex - 1
-						if (aeType == "Heartbeat" && HeartbeatLogs) || aeType == "AppendEntries" {
-							this.write_log("%s reply from NODE %d was failure; Hence, decrementing its nextIndex", aeType, peerId)
-						}
-					}
-				}
+	timeoutNowSent := false
+	var steppedDownAt time.Time
+	for {
+		this.mu.Lock()
+		if this.state != "Leader" || this.currentTerm != termWhenTransferStarted {
+			if steppedDownAt.IsZero() {
+				steppedDownAt = time.Now()
+			}
+			leaderId := this.leaderId
+			switch {
+			case leaderId == targetId:
+				this.write_log("stepped down; leadership transfer to %d is done", targetId)
+				this.mu.Unlock()
+				return nil
+			case leaderId != -1:
+				this.write_log("stepped down, but leadership went to %d rather than %d", leaderId, targetId)
+				this.mu.Unlock()
+				return ErrTransferFailed
+			case time.Since(steppedDownAt) > this.cfg.ElectionTimeoutMin:
+				this.write_log("stepped down, but heard from no leader after the transfer to %d", targetId)
+				this.mu.Unlock()
+				return ErrTransferTimeout
+			}
+			this.mu.Unlock()
+			<-ticker.C
+			continue
+		}
+		if time.Now().After(deadline) {
+			// Once TimeoutNow may have reached the target, leaseSuspendedUntil keeps LeaseRead off instead
+			this.leadTransferee = -1
+			this.write_log("leadership transfer to %d timed out", targetId)
+			this.mu.Unlock()
+			return ErrTransferTimeout
+		}
+		caughtUp := this.matchIndex[targetId] == this.lastLogIndex()
+		this.mu.Unlock()
+
+		if !caughtUp {
+			this.broadcastHeartbeats()
+		} else if !timeoutNowSent {
+			args := TimeoutNowArgs{
+				Term:     termWhenTransferStarted,
+				LeaderId: this.id,
 			}
-		}(peerId)
+			this.write_log("sending TimeoutNow to %d: %+v", targetId, args)
+
+			var reply TimeoutNowReply
+			err := this.call(ctx, targetId, "RaftNode.TimeoutNow", args, &reply)
+			// Even a call that failed may have been delivered, and the election it starts may outlive our lease
+			this.mu.Lock()
+			this.leaseSuspendedUntil = time.Now().Add(this.cfg.ElectionTimeoutMin)
+			this.mu.Unlock()
+			if err == nil {
+				timeoutNowSent = true
+			}
+		}
+		<-ticker.C
 	}
 }
@@ -1,62 +1,144 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
-const HeartbeatLogs = false
-const VoteRequestLogs = true
+type EntryType int
+
+const (
+	EntryCommand       EntryType = iota // A client command, applied to the state machine
+	EntryConfiguration                  // A Configuration, used by Raft itself
+	EntryNoOp                           // Appended by a new leader so that it can commit entries from earlier terms
+)
 
 type LogEntry struct {
 	Command interface{}
 	Term    int
+	Type    EntryType
+
+	// The client session the command was sent in, 0 if none; see ProposeInSession
+	ClientId int64
+	Sequence int64
+}
+
+// ApplyMsg is delivered on the apply channel for every committed command, and for every
+// snapshot that replaces the state applied so far, in log order. Entries Raft uses
+// internally, such as configurations, are not delivered.
+type ApplyMsg struct {
+	CommandValid bool
+	Command      interface{}
+	CommandIndex int
+	CommandTerm  int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotIndex int
+	SnapshotTerm  int
 }
 
 // Main Raft Data Structure
 type RaftNode struct {
 	mu sync.Mutex
 
-	id       int
-	peersIds []int
+	id  int
+	cfg Config // Timing and behaviour settings, never changed once the node is running
+
+	// Cluster membership, from the latest configuration entry in the log (committed or not)
+	config      Configuration
+	configIndex int
 
 	// Persistent state on all servers
 	currentTerm int
 	votedFor    int
-	log         []LogEntry
+	log         []LogEntry // log[0] is the entry at index lastIncludedIndex+1
+
+	// Log prefix up to lastIncludedIndex, compacted into snapshot
+	lastIncludedIndex    int
+	lastIncludedTerm     int
+	lastIncludedConfig   Configuration           // Configuration in effect at lastIncludedIndex
+	lastIncludedSessions map[int64]clientSession // Client sessions as of lastIncludedIndex
+	snapshot             []byte
 
 	// Volatile state on all servers
 	commitIndex int
 	lastApplied int
+	sessions    map[int64]clientSession // Client sessions as of lastApplied, by ClientId
+
+	// What each change to sessions after lastIncludedIndex replaced, oldest first, to go back to any applied index
+	sessionHistory []sessionChange
 
 	// Volatile Raft state on leaders
-	nextIndex  map[int]int
-	matchIndex map[int]int
+	nextIndex   map[int]int
+	matchIndex  map[int]int
+	lastAck     map[int]time.Time // Send time of the latest request each peer answered in our term
+	replicators map[int]*replicator
+
+	// Peer leadership is being handed to, -1 when no transfer is in progress
+	leadTransferee int
+	// A target sent TimeoutNow may win votes that skip the lease, so there is none until this time
+	leaseSuspendedUntil time.Time
+
+	// Proposals made on this node, by the index of their entry
+	pendingProposals map[int]*CommitFuture
 
 	// Utility States
 	state                        string
+	leaderId                     int // Leader of currentTerm as far as we know, -1 if unknown
 	lastElectionTimerStartedTime time.Time
-	notifyToApplyCommit          chan int
+	lastLeaderContact            time.Time // Last AppendEntries or InstallSnapshot from a current leader
+	applyCond                    *sync.Cond // Signalled when commitIndex or lastIncludedIndex moves past lastApplied, and when lastApplied moves
+	quit                         chan interface{}
 	LOG_ENTRIES                  bool
-	filePath                     string
 
 	// Networking Component
-	server *Server
+	transport   Transport
+	stateCtx    context.Context // Cancelled when we leave state or currentTerm, along with the RPCs sent in it
+	cancelState context.CancelFunc
+	rpcStats    map[string]*RPCStats
+
+	// Stable storage for the persistent state
+	persister Persister
+
+	// Consumers of committed entries
+	stateMachine StateMachine
+	applyCh      chan<- ApplyMsg
 }
 
-// Constructor for RaftNodes
-func NewRaftNode(id int, peersIds []int, server *Server, ready <-chan interface{}) *RaftNode {
+/* Constructor for RaftNodes
+A node bootstraps a cluster made of itself and peersIds. With nil peersIds it starts out with no
+configuration instead, and waits for the leader of an existing cluster to add it.
+Committed entries are applied to stateMachine and then sent on applyCh; either may be nil.
+Both are fed from a single goroutine, so a consumer that is slow to receive from applyCh
+holds back lastApplied (and snapshots) but never replication, commitment or elections.
+applyCh is closed once the node has been killed with KillNode. */
+func NewRaftNode(id int, peersIds []int, transport Transport, config Config, persister Persister, stateMachine StateMachine, applyCh chan<- ApplyMsg, ready <-chan interface{}) (*RaftNode, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	this := new(RaftNode)
 
-	this.server = server
-	this.notifyToApplyCommit = make(chan int, 16)
+	this.transport = transport
+	this.persister = persister
+	this.stateMachine = stateMachine
+	this.applyCh = applyCh
+	this.applyCond = sync.NewCond(&this.mu)
+	this.quit = make(chan interface{})
 
 	this.id = id
-	this.peersIds = peersIds
+	this.cfg = config
+	if peersIds != nil {
+		this.lastIncludedConfig = Configuration{Voters: append([]int{id}, peersIds...)}
+		sort.Ints(this.lastIncludedConfig.Voters)
+	}
 
 	this.votedFor = -1
 	this.currentTerm = 0
@@ -64,16 +146,29 @@ func NewRaftNode(id int, peersIds []int, server *Server, ready <-chan interface{
 	this.commitIndex = -1
 	this.lastApplied = -1
 
+	this.lastIncludedIndex = -1
+	this.lastIncludedTerm = -1
+
 	this.nextIndex = make(map[int]int)
 	this.matchIndex = make(map[int]int)
+	this.lastAck = make(map[int]time.Time)
+	this.replicators = make(map[int]*replicator)
+	this.leadTransferee = -1
 
+	this.pendingProposals = make(map[int]*CommitFuture)
+	this.sessions = make(map[int64]clientSession)
+	this.lastIncludedSessions = make(map[int64]clientSession)
+
+	this.stateCtx, this.cancelState = context.WithCancel(context.Background())
+	this.rpcStats = make(map[string]*RPCStats)
 	this.state = "Follower"
+	this.leaderId = -1
 
-	this.LOG_ENTRIES = true
+	this.LOG_ENTRIES = config.Logging
 
-	this.filePath = "NodeLogs/" + strconv.Itoa(this.id)
-	f, _ := os.Create(this.filePath)
-	f.Close()
+	this.readPersist()
+	this.refreshConfiguration()
+	this.commitIndex = this.lastIncludedIndex // Everything in the snapshot is committed; lastApplied catches up in the apply loop
 
 	go func() {
 		// Signalled when all servers are up and running, ready to receive RPCs
@@ -88,39 +183,248 @@ func NewRaftNode(id int, peersIds []int, server *Server, ready <-chan interface{
 
 	go this.applyCommitedLogEntries() // Fire off watcher to apply any committed entries
 
-	return this
+	return this, nil
 }
 
-// This function implements the 'application' of a query to the leader
-// This is the function that also writes queries accepted by the leader to files
-// to observe as output
+// This function implements the 'application' of committed queries to the state machine and applyCh.
+// this.mu is released while they are fed, so neither can stall the rest of the node.
 func (this *RaftNode) applyCommitedLogEntries() {
-	for range this.notifyToApplyCommit {
-		this.mu.Lock()
+	this.mu.Lock()
+	defer this.mu.Unlock()
 
-		var entriesToApply []LogEntry
+	for {
+		for !this.killed() && this.lastApplied >= this.commitIndex && this.lastApplied >= this.lastIncludedIndex {
+			this.applyCond.Wait()
+		}
+		if this.killed() {
+			break
+		}
 
-		if this.commitIndex > this.lastApplied {
-			entriesToApply = this.log[this.lastApplied+1 : this.commitIndex+1]
+		// A snapshot installed by the leader (or restored on startup) replaces everything applied so far
+		if this.lastApplied < this.lastIncludedIndex {
+			msg := ApplyMsg{
+				SnapshotValid: true,
+				Snapshot:      this.snapshot,
+				SnapshotIndex: this.lastIncludedIndex,
+				SnapshotTerm:  this.lastIncludedTerm,
+			}
+			this.sessions = copySessions(this.lastIncludedSessions)
+			this.sessionHistory = nil
+			this.mu.Unlock()
+
+			if this.stateMachine != nil {
+				if err := this.stateMachine.Restore(msg.Snapshot); err != nil {
+					log.Fatalf("AT NODE %d: could not restore snapshot at index %d: %v", this.id, msg.SnapshotIndex, err)
+				}
+			}
+			delivered := this.deliver(msg)
+
+			this.mu.Lock()
+			if !delivered {
+				break
+			}
+			if this.lastApplied < msg.SnapshotIndex {
+				this.lastApplied = msg.SnapshotIndex
+				this.applyCond.Broadcast()
+			}
+			continue
 		}
 
-		f, _ := os.OpenFile(this.filePath, os.O_APPEND|os.O_WRONLY, 0644)
+		firstIndex := this.lastApplied + 1
+		entriesToApply := append([]LogEntry(nil), this.logSlice(firstIndex, this.commitIndex+1)...)
+		lastAppliedIndex := this.commitIndex
+		duplicates := this.findDuplicates(entriesToApply)
+		takeSnapshot := this.stateMachine != nil && this.cfg.SnapshotThreshold > 0 &&
+			lastAppliedIndex-this.lastIncludedIndex >= this.cfg.SnapshotThreshold
+		this.mu.Unlock()
+
+		delivered := true
+		results := make([]interface{}, len(entriesToApply))
+		for i, entry := range entriesToApply {
+			var result interface{}
+			if entry.Type == EntryCommand && !duplicates[i] && this.stateMachine != nil {
+				result = this.stateMachine.Apply(firstIndex+i, entry)
+			}
+
+			// lastApplied moves before the entry is sent, so whoever receives it can Snapshot at its index
+			this.mu.Lock()
+			this.lastApplied = firstIndex + i
+			results[i] = this.recordSession(firstIndex+i, entry, duplicates[i], result)
+			this.applyCond.Broadcast()
+			this.mu.Unlock()
+
+			if entry.Type != EntryCommand || duplicates[i] {
+				continue
+			}
+			delivered = this.deliver(ApplyMsg{
+				CommandValid: true,
+				Command:      entry.Command,
+				CommandIndex: firstIndex + i,
+				CommandTerm:  entry.Term,
+			})
+			if !delivered {
+				break
+			}
+		}
 
-		defer f.Close()
+		var snapshot []byte
+		var snapshotErr error
+		if delivered && takeSnapshot {
+			snapshot, snapshotErr = this.stateMachine.Snapshot()
+		}
 
+		this.mu.Lock()
+		if !delivered {
+			break
+		}
 		for i, entry := range entriesToApply {
-			strentry := fmt.Sprintf("%s; T:[%d]; I:[%d]", entry.Command, this.currentTerm, this.commitIndex+i)
-			f.WriteString(strentry)
-			f.WriteString("\n")
+			this.resolveProposal(firstIndex+i, entry, results[i])
 		}
 
-		this.lastApplied = this.commitIndex
-		this.mu.Unlock()
+		if takeSnapshot {
+			if snapshotErr == nil {
+				this.takeSnapshot(lastAppliedIndex, snapshot)
+			} else {
+				this.write_log("could not take Snapshot: %v", snapshotErr)
+			}
+		}
 	}
 
+	// Nothing is sent on applyCh after this, so its consumer can tell the node is gone
+	if this.applyCh != nil {
+		close(this.applyCh)
+	}
 	this.write_log("applyCommitedLogEntries done")
 }
 
+// deliver sends msg on applyCh, blocking until it is received or the node is killed.
+func (this *RaftNode) deliver(msg ApplyMsg) bool {
+	if this.applyCh == nil {
+		return true
+	}
+	select {
+	case this.applyCh <- msg:
+		return true
+	case <-this.quit:
+		return false
+	}
+}
+
+/* LOG INDEXING */
+
+// Log indices are absolute: the entry at index i lives at this.log[i-this.lastIncludedIndex-1].
+// Index lastIncludedIndex (-1 when nothing is compacted) is the last entry covered by the snapshot.
+
+func (this *RaftNode) lastLogIndex() int {
+	return this.lastIncludedIndex + len(this.log)
+}
+
+func (this *RaftNode) lastLogTerm() int {
+	if len(this.log) > 0 {
+		return this.log[len(this.log)-1].Term
+	}
+	return this.lastIncludedTerm
+}
+
+// logTerm returns the term of the entry at index, which must not be before lastIncludedIndex.
+func (this *RaftNode) logTerm(index int) int {
+	if index == this.lastIncludedIndex {
+		return this.lastIncludedTerm
+	}
+	return this.log[index-this.lastIncludedIndex-1].Term
+}
+
+// logSlice returns the entries in [from, to), which must all be after lastIncludedIndex.
+func (this *RaftNode) logSlice(from int, to int) []LogEntry {
+	return this.log[from-this.lastIncludedIndex-1 : to-this.lastIncludedIndex-1]
+}
+
+/* PERSISTENCE */
+
+func (this *RaftNode) encodeState() []byte {
+	buffer := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buffer)
+	if err := encoder.Encode(this.currentTerm); err != nil {
+		log.Fatalf("AT NODE %d: could not encode currentTerm: %v", this.id, err)
+	}
+	if err := encoder.Encode(this.votedFor); err != nil {
+		log.Fatalf("AT NODE %d: could not encode votedFor: %v", this.id, err)
+	}
+	if err := encoder.Encode(this.log); err != nil {
+		log.Fatalf("AT NODE %d: could not encode log: %v", this.id, err)
+	}
+	if err := encoder.Encode(this.lastIncludedIndex); err != nil {
+		log.Fatalf("AT NODE %d: could not encode lastIncludedIndex: %v", this.id, err)
+	}
+	if err := encoder.Encode(this.lastIncludedTerm); err != nil {
+		log.Fatalf("AT NODE %d: could not encode lastIncludedTerm: %v", this.id, err)
+	}
+	if err := encoder.Encode(this.lastIncludedConfig); err != nil {
+		log.Fatalf("AT NODE %d: could not encode lastIncludedConfig: %v", this.id, err)
+	}
+	return buffer.Bytes()
+}
+
+// persist saves currentTerm, votedFor and log to stable storage.
+// It must be called with this.mu held, after any change to them and before replying to the RPC that caused it.
+func (this *RaftNode) persist() {
+	if err := this.persister.SaveRaftState(this.encodeState()); err != nil {
+		log.Fatalf("AT NODE %d: could not persist state: %v", this.id, err)
+	}
+}
+
+// persistStateAndSnapshot is persist for when the snapshot changed too.
+func (this *RaftNode) persistStateAndSnapshot() {
+	snapshot := encodeSnapshot(this.lastIncludedIndex, this.lastIncludedTerm, this.lastIncludedConfig, this.lastIncludedSessions, this.snapshot)
+	if err := this.persister.SaveStateAndSnapshot(this.encodeState(), snapshot); err != nil {
+		log.Fatalf("AT NODE %d: could not persist state and snapshot: %v", this.id, err)
+	}
+}
+
+// readPersist restores the state saved by persist, if there is any.
+func (this *RaftNode) readPersist() {
+	data, err := this.persister.ReadRaftState()
+	if err != nil {
+		log.Fatalf("AT NODE %d: could not read persisted state: %v", this.id, err)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	var currentTerm, votedFor, lastIncludedIndex, lastIncludedTerm int
+	var entries []LogEntry
+	var lastIncludedConfig Configuration
+
+	decoder := gob.NewDecoder(bytes.NewBuffer(data))
+	if decoder.Decode(&currentTerm) != nil || decoder.Decode(&votedFor) != nil || decoder.Decode(&entries) != nil ||
+		decoder.Decode(&lastIncludedIndex) != nil || decoder.Decode(&lastIncludedTerm) != nil || decoder.Decode(&lastIncludedConfig) != nil {
+		log.Fatalf("AT NODE %d: persisted state is corrupt", this.id)
+	}
+
+	this.currentTerm = currentTerm
+	this.votedFor = votedFor
+	this.log = entries
+	this.lastIncludedIndex = lastIncludedIndex
+	this.lastIncludedTerm = lastIncludedTerm
+	this.lastIncludedConfig = lastIncludedConfig
+
+	snapshot, err := this.persister.ReadSnapshot()
+	if err != nil {
+		log.Fatalf("AT NODE %d: could not read persisted snapshot: %v", this.id, err)
+	}
+	if len(snapshot) > 0 {
+		snapshotIndex, snapshotTerm, snapshotConfig, sessions, data := decodeSnapshot(snapshot)
+		this.snapshot = data
+		this.lastIncludedSessions = sessions
+
+		// The snapshot was saved but we crashed before the state that goes with it
+		if snapshotIndex > this.lastIncludedIndex {
+			this.compactLogUpTo(snapshotIndex, snapshotTerm, snapshotConfig)
+		}
+	}
+	this.write_log("restored persisted state: term=%d, votedFor=%d, lastIncludedIndex=%d, log=%v", this.currentTerm, this.votedFor, this.lastIncludedIndex, this.log)
+}
+
 /* UTILITY FUNCTIONS */
 
 // GetNodeState reports the state of this RN.
@@ -134,9 +438,20 @@ func (this *RaftNode) GetNodeState() (id int, term int, isLeader bool) {
 func (this *RaftNode) KillNode() {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	this.state = "Dead"
+	this.setState("Dead", this.currentTerm)
 	this.write_log("KILLED")
-	close(this.notifyToApplyCommit)
+	close(this.quit)
+	this.applyCond.Broadcast()
+	this.failProposals(0, math.MaxInt, ErrNodeKilled)
+}
+
+func (this *RaftNode) killed() bool {
+	select {
+	case <-this.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 // This function logs all messages to the terminal
@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Persister is the stable storage a RaftNode writes its persistent state
+// (currentTerm, votedFor and the log) to. A RaftNode saves to it before it
+// replies to any RPC that changed that state, and reads it back on startup.
+// The latest snapshot, which replaces the compacted log prefix, is kept next to it.
+type Persister interface {
+	SaveRaftState(state []byte) error
+	ReadRaftState() ([]byte, error)
+	SaveStateAndSnapshot(state []byte, snapshot []byte) error
+	ReadSnapshot() ([]byte, error)
+}
+
+/* In-memory Persister, used by the test harness to simulate restarts */
+
+type MemoryPersister struct {
+	mu        sync.Mutex
+	raftState []byte
+	snapshot  []byte
+}
+
+func NewMemoryPersister() *MemoryPersister {
+	return new(MemoryPersister)
+}
+
+func (this *MemoryPersister) SaveRaftState(state []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.raftState = clone(state)
+	return nil
+}
+
+func (this *MemoryPersister) ReadRaftState() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return clone(this.raftState), nil
+}
+
+func (this *MemoryPersister) SaveStateAndSnapshot(state []byte, snapshot []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.raftState = clone(state)
+	this.snapshot = clone(snapshot)
+	return nil
+}
+
+func (this *MemoryPersister) ReadSnapshot() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return clone(this.snapshot), nil
+}
+
+/* File-backed Persister, the state and the snapshot are kept in two files inside dir */
+
+type FilePersister struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewFilePersister(dir string) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	this := new(FilePersister)
+	this.dir = dir
+	return this, nil
+}
+
+func (this *FilePersister) SaveRaftState(state []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return writeFileAtomic(filepath.Join(this.dir, "raftstate"), state)
+}
+
+func (this *FilePersister) ReadRaftState() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return readFileIfExists(filepath.Join(this.dir, "raftstate"))
+}
+
+// SaveStateAndSnapshot writes the snapshot before the state. A crash in between leaves
+// a snapshot newer than the state, which the RaftNode detects and reconciles on startup.
+func (this *FilePersister) SaveStateAndSnapshot(state []byte, snapshot []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err := writeFileAtomic(filepath.Join(this.dir, "snapshot"), snapshot); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(this.dir, "raftstate"), state)
+}
+
+func (this *FilePersister) ReadSnapshot() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return readFileIfExists(filepath.Join(this.dir, "snapshot"))
+}
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it
+// over path, so a crash never leaves a half written state behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func readFileIfExists(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func clone(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
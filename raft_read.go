@@ -0,0 +1,228 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrNoCommitInTerm = errors.New("raft: leader has not committed an entry in its term yet")
+var ErrReadTimeout = errors.New("raft: could not confirm leadership for a read")
+var ErrQueryNotSupported = errors.New("raft: state machine does not answer queries")
+var ErrLeaseExpired = errors.New("raft: leader lease has expired")
+var ErrLeaderUnknown = errors.New("raft: no known leader to get a read index from")
+
+/* ReadIndex lets a read observe every write committed before it started, without appending
+anything to the log. The leader records its commitIndex as the read index, confirms it is still
+leader by hearing back from a quorum about requests sent after that, and then waits until it
+has applied up to the read index, which it returns. */
+func (this *RaftNode) ReadIndex() (int, error) {
+	readIndex, err := this.confirmReadIndex()
+	if err != nil {
+		return -1, err
+	}
+	if err := this.waitForApplied(readIndex); err != nil {
+		return -1, err
+	}
+	return readIndex, nil
+}
+
+// confirmReadIndex records the leader's commitIndex and returns it once a quorum has confirmed we are still leader.
+func (this *RaftNode) confirmReadIndex() (int, error) {
+	this.mu.Lock()
+	if this.state != "Leader" {
+		err := this.notLeader()
+		this.mu.Unlock()
+		return -1, err
+	}
+	// Until it commits an entry of its own term, a new leader cannot know how far commitIndex really is
+	if this.logTerm(this.commitIndex) != this.currentTerm {
+		this.mu.Unlock()
+		return -1, ErrNoCommitInTerm
+	}
+	readIndex := this.commitIndex
+	termWhenReadStarted := this.currentTerm
+	roundStarted := time.Now()
+	this.mu.Unlock()
+
+	this.broadcastHeartbeats()
+
+	deadline := roundStarted.Add(this.cfg.ElectionTimeoutMin)
+	ticker := time.NewTicker(this.cfg.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		this.mu.Lock()
+		if this.state != "Leader" || this.currentTerm != termWhenReadStarted {
+			err := this.notLeader()
+			this.mu.Unlock()
+			return -1, err
+		}
+		if this.hasQuorumAckSince(roundStarted) {
+			this.write_log("confirmed leadership for read at index %d", readIndex)
+			this.mu.Unlock()
+			return readIndex, nil
+		}
+		this.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return -1, ErrReadTimeout
+		}
+		<-ticker.C
+	}
+}
+
+// waitForApplied waits, for at most an election timeout, until this has applied every entry up to index.
+func (this *RaftNode) waitForApplied(index int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	timedOut := false
+	timer := time.AfterFunc(this.cfg.ElectionTimeoutMin, func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		timedOut = true
+		this.applyCond.Broadcast()
+	})
+	defer timer.Stop()
+
+	for this.lastApplied < index && !this.killed() && !timedOut {
+		this.applyCond.Wait()
+	}
+	switch {
+	case this.lastApplied >= index:
+		return nil
+	case this.killed():
+		return ErrNodeKilled
+	default:
+		return ErrReadTimeout
+	}
+}
+
+// Read answers query from the state machine once ReadIndex has made it safe to, so it reflects every committed write.
+func (this *RaftNode) Read(query interface{}) (interface{}, error) {
+	querier, ok := this.stateMachine.(QueryableStateMachine)
+	if !ok {
+		return nil, ErrQueryNotSupported
+	}
+	if _, err := this.ReadIndex(); err != nil {
+		return nil, err
+	}
+	return querier.Query(query)
+}
+
+/* FollowerRead serves a linearizable read on any node, to spread reads away from the leader.
+A follower asks the leader it last heard from for a read index with a ReadIndex RPC, waits until
+it has applied up to that index itself, and then answers query from its own state machine. */
+func (this *RaftNode) FollowerRead(query interface{}) (interface{}, error) {
+	querier, ok := this.stateMachine.(QueryableStateMachine)
+	if !ok {
+		return nil, ErrQueryNotSupported
+	}
+
+	this.mu.Lock()
+	leaderId, ctx := this.leaderId, this.stateCtx
+	this.mu.Unlock()
+
+	if leaderId == this.id {
+		return this.Read(query)
+	}
+	if leaderId == -1 {
+		return nil, ErrLeaderUnknown
+	}
+
+	args := ReadIndexArgs{
+		FollowerId: this.id,
+	}
+	var reply ReadIndexReply
+	if err := this.call(ctx, leaderId, "RaftNode.ReadIndex", args, &reply); err != nil {
+		return nil, err
+	}
+	if !reply.Success {
+		return nil, fmt.Errorf("raft: leader %d could not give a read index", leaderId)
+	}
+	this.write_log("got read index %d from leader %d", reply.ReadIndex, leaderId)
+
+	if err := this.waitForApplied(reply.ReadIndex); err != nil {
+		return nil, err
+	}
+	return querier.Query(query)
+}
+
+/* LeaseRead answers query from the state machine without contacting any other server. A follower
+that answered a request we sent at time t will not help elect another leader before t plus an
+election timeout, so until then (less an allowance for clock drift) no other leader can have
+committed a write. During a leadership transfer the target is told to skip that wait, so there
+is no lease, and none for an election timeout after it was sent TimeoutNow, even if the transfer
+timed out. */
+func (this *RaftNode) LeaseRead(query interface{}) (interface{}, error) {
+	querier, ok := this.stateMachine.(QueryableStateMachine)
+	if !ok {
+		return nil, ErrQueryNotSupported
+	}
+
+	this.mu.Lock()
+	if err := this.checkLease(); err != nil {
+		this.mu.Unlock()
+		return nil, err
+	}
+	readIndex := this.commitIndex
+	this.mu.Unlock()
+
+	// Entries up to commitIndex may still be on their way to the state machine,
+	if err := this.waitForApplied(readIndex); err != nil {
+		return nil, err
+	}
+
+	// and the lease may have run out while they got there
+	this.mu.Lock()
+	err := this.checkLease()
+	this.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return querier.Query(query)
+}
+
+// checkLease returns why this cannot serve a lease read right now, or nil if it can.
+func (this *RaftNode) checkLease() error {
+	switch {
+	case this.state != "Leader":
+		return this.notLeader()
+	case this.leadTransferee != -1:
+		return ErrTransferInProgress
+	case this.logTerm(this.commitIndex) != this.currentTerm:
+		return ErrNoCommitInTerm
+	case time.Now().Before(this.leaseSuspendedUntil) || !time.Now().Before(this.leaseExpiry()):
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+/* leaseExpiry is when the lease of a leader that has committed in its term runs out. The acks
+startLeader fills in at election time are all older than those the commit needed from a quorum,
+so they never extend it. */
+func (this *RaftNode) leaseExpiry() time.Time {
+	lease := this.cfg.ElectionTimeoutMin - this.cfg.MaxClockDrift
+	return this.quorumAckTime().Add(lease)
+}
+
+// quorumAckTime returns the latest time t such that a quorum, counting this, answered requests sent at or after t.
+func (this *RaftNode) quorumAckTime() time.Time {
+	if this.config.hasQuorum(map[int]bool{this.id: true}) {
+		return time.Now()
+	}
+
+	acks := make([]time.Time, 0)
+	for _, peerId := range this.peers() {
+		acks = append(acks, this.lastAck[peerId])
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+	for _, t := range acks {
+		if this.hasQuorumAckSince(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,263 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+)
+
+/* A replicator is the long-lived goroutine a leader runs for each of its peers. It is woken
+whenever there may be something to send: new entries from Propose, a heartbeat from the
+ticker, or a reply that freed a slot in the window. Up to MaxInflightAppends AppendEntries
+are sent without waiting for earlier replies, nextIndex is moved past each batch as soon as
+it is sent, and replies are folded back in whatever order they arrive.
+
+Like etcd's Progress, a replicator is in one of two modes. In "Probe" mode we do not know where
+the peer's log matches ours, so one request carrying at most one entry is sent at a time until
+one is accepted. In "Replicate" mode the peer is known to be following along, and full batches
+are pipelined. All fields are guarded by the node's mu. */
+type replicator struct {
+	peerId int
+	term   int             // The term we are leading in; a replicator never outlives it
+	ctx    context.Context // stateCtx of our leadership, cancels outstanding requests when it ends
+
+	trigger chan interface{} // Buffered, holds at most one pending wake-up
+	stop    chan interface{}
+
+	mode            string // "Probe" or "Replicate"
+	heartbeatDue    bool   // Send even if there are no new entries
+	inflight        int    // Requests sent that have not been answered yet
+	sendingSnapshot bool   // Nothing else is sent while an InstallSnapshot is outstanding
+}
+
+func (this *replicator) notify() {
+	select {
+	case this.trigger <- nil:
+	default:
+	}
+}
+
+/* Management of the replicators, all called with this.mu held */
+
+// syncReplicators starts a replicator for every peer that lacks one, and stops those no longer in the configuration.
+func (this *RaftNode) syncReplicators() {
+	peers := this.peers()
+	for peerId, r := range this.replicators {
+		if !containsId(peers, peerId) {
+			close(r.stop)
+			delete(this.replicators, peerId)
+		}
+	}
+	for _, peerId := range peers {
+		if _, ok := this.replicators[peerId]; !ok {
+			r := &replicator{
+				peerId:  peerId,
+				term:    this.currentTerm,
+				ctx:     this.stateCtx,
+				mode:    "Probe",
+				trigger: make(chan interface{}, 1),
+				stop:    make(chan interface{}),
+			}
+			this.replicators[peerId] = r
+			go this.runReplicator(r)
+		}
+	}
+}
+
+// stopReplicators stops every replicator, once we are no longer leader.
+func (this *RaftNode) stopReplicators() {
+	for peerId, r := range this.replicators {
+		close(r.stop)
+		delete(this.replicators, peerId)
+	}
+}
+
+// triggerReplication wakes every replicator to send whatever entries its peer is missing.
+func (this *RaftNode) triggerReplication() {
+	for _, r := range this.replicators {
+		r.notify()
+	}
+}
+
+func (this *RaftNode) runReplicator(r *replicator) {
+	for {
+		select {
+		case <-r.trigger:
+		case <-r.stop:
+			return
+		case <-this.quit:
+			return
+		}
+
+		this.mu.Lock()
+		if this.state == "Leader" && this.currentTerm == r.term {
+			this.replicate(r)
+		}
+		this.mu.Unlock()
+	}
+}
+
+// replicate sends r's peer as much as the window allows, called with this.mu held.
+func (this *RaftNode) replicate(r *replicator) {
+	window, maxEntries := this.cfg.MaxInflightAppends, this.cfg.MaxEntriesPerAppend
+	if r.mode == "Probe" {
+		window, maxEntries = 1, 1
+	}
+
+	for r.inflight < window && !r.sendingSnapshot {
+		currentPeer_nextIndex := this.nextIndex[r.peerId]
+		if currentPeer_nextIndex <= this.lastIncludedIndex {
+			// The entries this peer needs have been compacted, send it our snapshot instead
+			r.mode = "Probe" // Find out where the peer's log picks up after the snapshot
+			r.sendingSnapshot = true
+			r.heartbeatDue = false
+			r.inflight++
+			go func() {
+				this.sendSnapshot(r.ctx, r.peerId, r.term)
+
+				this.mu.Lock()
+				defer this.mu.Unlock()
+				r.sendingSnapshot = false
+				r.inflight--
+				if this.nextIndex[r.peerId] > this.lastIncludedIndex {
+					r.notify() // Installed, carry on with the entries after it
+				}
+			}()
+			return
+		}
+		if currentPeer_nextIndex > this.lastLogIndex() && !r.heartbeatDue {
+			return
+		}
+		r.heartbeatDue = false
+
+		prevLogIndex := currentPeer_nextIndex - 1
+		args := AppendEntriesArgs{
+			Term:         r.term,
+			LeaderId:     this.id,
+			PrevLogIndex: prevLogIndex,
+			PrevLogTerm:  this.logTerm(prevLogIndex),
+			Entries:      this.entriesToSend(currentPeer_nextIndex, maxEntries),
+			LeaderCommit: this.commitIndex,
+		}
+
+		// Assume the batch will land; a failed or rejected send moves nextIndex back
+		this.nextIndex[r.peerId] = currentPeer_nextIndex + len(args.Entries)
+		r.inflight++
+		go this.sendAppendEntries(r, args)
+	}
+}
+
+// sendAppendEntries sends one AppendEntries to r's peer and folds the reply into nextIndex and matchIndex.
+func (this *RaftNode) sendAppendEntries(r *replicator, args AppendEntriesArgs) {
+	peerId := r.peerId
+
+	var aeType string
+	if len(args.Entries) > 0 {
+		aeType = "AppendEntries"
+	} else {
+		aeType = "Heartbeat"
+	}
+	logThis := (aeType == "Heartbeat" && this.cfg.LogHeartbeats) || aeType == "AppendEntries"
+	if logThis {
+		this.write_log("sending %s to %v: args=%+v", aeType, peerId, args)
+	}
+
+	var reply AppendEntriesReply
+	sentAt := time.Now()
+	err := this.call(r.ctx, peerId, "RaftNode.AppendEntries", args, &reply)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	r.inflight--
+
+	if err == nil && reply.Term > this.currentTerm {
+		this.becomeFollower(reply.Term)
+		return
+	}
+	if this.state != "Leader" || this.currentTerm != r.term {
+		return
+	}
+	if err != nil || reply.Term != r.term {
+		r.mode = "Probe"
+		// The batch never arrived. It is sent again with the next heartbeat, not straight
+		// away, so an unreachable peer is not flooded with retries.
+		this.rewindNextIndex(peerId, args.PrevLogIndex+1)
+		return
+	}
+	defer r.notify() // A slot in the window is free again
+
+	this.recordAck(peerId, sentAt)
+	lastSentIndex := args.PrevLogIndex + len(args.Entries)
+	if reply.Success {
+		if lastSentIndex > this.matchIndex[peerId] {
+			this.matchIndex[peerId] = lastSentIndex
+		}
+		if this.nextIndex[peerId] <= lastSentIndex {
+			this.nextIndex[peerId] = lastSentIndex + 1
+		}
+		if r.mode == "Probe" {
+			r.mode = "Replicate"
+			this.write_log("NODE %d is caught up to %d, switching it to Replicate mode", peerId, lastSentIndex)
+		}
+		if logThis {
+			this.write_log("%s reply from NODE %d success: nextIndex := %v, matchIndex := %v", aeType, peerId, this.nextIndex, this.matchIndex)
+		}
+		this.advanceCommitIndex()
+	} else if args.PrevLogIndex > this.matchIndex[peerId] && args.PrevLogIndex < this.nextIndex[peerId] {
+		// Rejections of requests sent before we last backed up, or of a point we have since matched, are stale
+		this.rewindNextIndex(peerId, this.backtrackNextIndex(args.PrevLogIndex+1, reply))
+		r.mode = "Probe"
+		if logThis {
+			this.write_log("%s reply from NODE %d was failure (conflictTerm=%d, conflictIndex=%d); Hence, nextIndex := %d", aeType, peerId, reply.ConflictTerm, reply.ConflictIndex, this.nextIndex[peerId])
+		}
+	}
+}
+
+// rewindNextIndex moves peerId's nextIndex back to index, but never to an entry it is known to hold.
+func (this *RaftNode) rewindNextIndex(peerId int, index int) {
+	if index <= this.matchIndex[peerId] {
+		index = this.matchIndex[peerId] + 1
+	}
+	if index < this.nextIndex[peerId] {
+		this.nextIndex[peerId] = index
+	}
+}
+
+/* entriesToSend returns the entries from index on to send in one AppendEntries: at most maxEntries
+of them and MaxBytesPerAppend of commands, but always at least one if there are any. */
+func (this *RaftNode) entriesToSend(index int, maxEntries int) []LogEntry {
+	entries := this.logSlice(index, this.lastLogIndex()+1)
+	if len(entries) > maxEntries {
+		entries = entries[:maxEntries]
+	}
+
+	size := 0
+	for i, entry := range entries {
+		size += commandSize(entry.Command)
+		if i > 0 && size > this.cfg.MaxBytesPerAppend {
+			entries = entries[:i]
+			break
+		}
+	}
+	return append([]LogEntry(nil), entries...)
+}
+
+/* commandSize is how many bytes of payload command adds to an AppendEntries: the length of the
+strings and byte slices commands usually are, without encoding them under this.mu on every send.
+Anything else, such as a Configuration, is measured by gob-encoding it. */
+func commandSize(command interface{}) int {
+	switch command := command.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(command)
+	case []byte:
+		return len(command)
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(command); err != nil {
+		return 0
+	}
+	return buffer.Len()
+}
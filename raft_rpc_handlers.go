@@ -1,6 +1,12 @@
 package raft
 
-import "time"
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+var ErrCommitTimeout = errors.New("raft: command was not applied in time")
 
 // Handles an incoming RPC RequestVote request
 
@@ -10,7 +16,7 @@ type RequestVoteArgs struct {
 	LastLogIndex int
 	LastLogTerm  int
 
-	Latency int
+	LeadershipTransfer bool // The election was started by TimeoutNow, so the current leader is stepping aside
 }
 
 type RequestVoteReply struct {
@@ -18,7 +24,9 @@ type RequestVoteReply struct {
 	VoteGranted bool
 }
 
-// RequestVote RPC.
+/* RequestVote RPC. While we still hear from a leader we ignore vote requests altogether, without
+so much as adopting their term, unless the leader is handing over to the candidate: a leader's
+lease relies on our not helping elect another one within an election timeout of answering it. */
 func (this *RaftNode) HandleRequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -27,17 +35,21 @@ func (this *RaftNode) HandleRequestVote(args RequestVoteArgs, reply *RequestVote
 		return nil
 	}
 
-	var nodeLastLogIndex, nodeLastLogTerm int
+	nodeLastLogIndex, nodeLastLogTerm := this.lastLogIndex(), this.lastLogTerm()
 
-	if len(this.log) > 0 {
-		lastIndex := len(this.log) - 1
-		nodeLastLogIndex, nodeLastLogTerm = lastIndex, this.log[lastIndex].Term
-	} else {
-		nodeLastLogIndex, nodeLastLogTerm = -1, -1
+	if this.cfg.LogVoteRequests {
+		this.write_log("Received Vote Request from NODE %d; Args: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args.CandidateId, args, this.currentTerm, this.votedFor, nodeLastLogIndex, nodeLastLogTerm)
 	}
 
-	if VoteRequestLogs {
-		this.write_log("Received Vote Request from NODE %d; Args: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args.CandidateId, args, this.currentTerm, this.votedFor, nodeLastLogIndex, nodeLastLogTerm)
+	heardFromLeader := this.state == "Leader" ||
+		time.Since(this.lastLeaderContact) < this.cfg.ElectionTimeoutMin
+	if heardFromLeader && !args.LeadershipTransfer {
+		reply.Term = this.currentTerm
+		reply.VoteGranted = false
+		if this.cfg.LogVoteRequests {
+			this.write_log("Ignoring Vote Request from NODE %d, still hearing from a leader", args.CandidateId)
+		}
+		return nil
 	}
 
 	if args.Term > this.currentTerm {
@@ -52,6 +64,7 @@ func (this *RaftNode) HandleRequestVote(args RequestVoteArgs, reply *RequestVote
 		reply.VoteGranted = true
 
 		this.votedFor = args.CandidateId
+		this.persist()
 		this.lastElectionTimerStartedTime = time.Now()
 
 	} else {
@@ -59,12 +72,57 @@ func (this *RaftNode) HandleRequestVote(args RequestVoteArgs, reply *RequestVote
 	}
 
 	reply.Term = this.currentTerm
-	if VoteRequestLogs {
+	if this.cfg.LogVoteRequests {
 		this.write_log("Sending Request Vote Reply: %+v", reply)
 	}
 	return nil
 }
 
+// Handles an incoming RPC PreVote request
+
+type PreVoteArgs struct {
+	Term         int // The term the candidate would start an election for, one past its currentTerm
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type PreVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+// PreVote RPC. Answers whether we would grant a vote at args.Term, without changing any of our state.
+func (this *RaftNode) HandlePreVote(args PreVoteArgs, reply *PreVoteReply) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.state == "Dead" {
+		return nil
+	}
+
+	nodeLastLogIndex, nodeLastLogTerm := this.lastLogIndex(), this.lastLogTerm()
+
+	if this.cfg.LogVoteRequests {
+		this.write_log("Received PreVote Request from NODE %d; Args: %+v [currentTerm=%d, log index/term=(%d, %d)]", args.CandidateId, args, this.currentTerm, nodeLastLogIndex, nodeLastLogTerm)
+	}
+
+	// A node that still hears from a leader has no reason to help replace it
+	heardFromLeader := this.state == "Leader" ||
+		time.Since(this.lastLeaderContact) < this.cfg.ElectionTimeoutMin
+
+	reply.VoteGranted = args.Term > this.currentTerm && // Pre-vote is for a term we have not reached yet AND
+		!heardFromLeader && // we haven't heard from a leader for an election timeout AND
+		(args.LastLogTerm > nodeLastLogTerm || // candidate is ATLEAST as up to date as us in terms of log entries
+			(args.LastLogTerm == nodeLastLogTerm && args.LastLogIndex >= nodeLastLogIndex))
+
+	reply.Term = this.currentTerm
+	if this.cfg.LogVoteRequests {
+		this.write_log("Sending PreVote Reply: %+v", reply)
+	}
+	return nil
+}
+
 // Handles an incoming RPC AppendEntries request
 
 type AppendEntriesArgs struct {
@@ -75,13 +133,17 @@ type AppendEntriesArgs struct {
 	PrevLogTerm  int
 	Entries      []LogEntry
 	LeaderCommit int
-
-	Latency int
 }
 
 type AppendEntriesReply struct {
 	Term    int
 	Success bool
+
+	// On a log mismatch, hints that let the leader back up past a whole term at once.
+	// ConflictTerm is the term of our entry at PrevLogIndex (-1 if our log is too short) and
+	// ConflictIndex is the first index we hold with that term (or one past our last entry).
+	ConflictTerm  int
+	ConflictIndex int
 }
 
 func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
@@ -98,7 +160,7 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 		aeType = "Heartbeat"
 	}
 
-	if (aeType == "Heartbeat" && HeartbeatLogs) || aeType == "AppendEntries" {
+	if (aeType == "Heartbeat" && this.cfg.LogHeartbeats) || aeType == "AppendEntries" {
 		this.write_log("Received %s from NODE %d; args: %+v", aeType, args.LeaderId, args)
 	}
 
@@ -112,10 +174,22 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 			this.becomeFollower(args.Term)
 		}
 		this.lastElectionTimerStartedTime = time.Now()
+		this.lastLeaderContact = this.lastElectionTimerStartedTime
+		this.leaderId = args.LeaderId
+
+		// Entries up to lastIncludedIndex are already in our snapshot, skip past them
+		if args.PrevLogIndex < this.lastIncludedIndex {
+			alreadyIncluded := this.lastIncludedIndex - args.PrevLogIndex
+			if alreadyIncluded < len(args.Entries) {
+				args.Entries = args.Entries[alreadyIncluded:]
+			} else {
+				args.Entries = nil
+			}
+			args.PrevLogIndex, args.PrevLogTerm = this.lastIncludedIndex, this.lastIncludedTerm
+		}
 
 		// Does our log contain an entry at PrevLogIndex whose term matches PrevLogTerm?
-		if args.PrevLogIndex == -1 ||
-			(args.PrevLogIndex < len(this.log) && args.PrevLogTerm == this.log[args.PrevLogIndex].Term) {
+		if args.PrevLogIndex <= this.lastLogIndex() && args.PrevLogTerm == this.logTerm(args.PrevLogIndex) {
 			reply.Success = true
 
 			// Find an insertion point - where there's a term mismatch between
@@ -125,10 +199,10 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 			newEntriesIndex := 0
 
 			for {
-				if logInsertIndex >= len(this.log) || newEntriesIndex >= len(args.Entries) {
+				if logInsertIndex > this.lastLogIndex() || newEntriesIndex >= len(args.Entries) {
 					break
 				}
-				if this.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+				if this.logTerm(logInsertIndex) != args.Entries[newEntriesIndex].Term {
 					break
 				}
 				logInsertIndex++
@@ -140,41 +214,325 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 			// - newEntriesIndex points at the end of Entries, or an index where the
 			//   term mismatches with the corresponding log entry
 			if newEntriesIndex < len(args.Entries) {
-				this.log = append(this.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
+				if logInsertIndex <= this.lastLogIndex() {
+					this.failProposals(logInsertIndex, math.MaxInt, ErrEntryOverwritten)
+				}
+				this.log = append(this.logSlice(this.lastIncludedIndex+1, logInsertIndex), args.Entries[newEntriesIndex:]...)
+				this.persist()
+				this.refreshConfiguration()
 				this.write_log("Log is now: %v", this.log)
 			}
 
-			// Set commit index.
-			if args.LeaderCommit > this.commitIndex {
+			// Set commit index, never past the last entry this leader has confirmed we share with it.
+			lastNewEntryIndex := args.PrevLogIndex + len(args.Entries)
+			if args.LeaderCommit > this.commitIndex && lastNewEntryIndex > this.commitIndex {
 
-				if args.LeaderCommit < len(this.log)-1 {
-					this.commitIndex = len(this.log) - 1
-				} else {
+				if args.LeaderCommit < lastNewEntryIndex {
 					this.commitIndex = args.LeaderCommit
+				} else {
+					this.commitIndex = lastNewEntryIndex
 				}
 
-				this.notifyToApplyCommit <- 1
+				this.applyCond.Broadcast()
+			}
+		} else if args.PrevLogIndex > this.lastLogIndex() {
+			reply.ConflictTerm = -1
+			reply.ConflictIndex = this.lastLogIndex() + 1
+		} else {
+			reply.ConflictTerm = this.logTerm(args.PrevLogIndex)
+			reply.ConflictIndex = args.PrevLogIndex
+			for reply.ConflictIndex > this.lastIncludedIndex+1 && this.logTerm(reply.ConflictIndex-1) == reply.ConflictTerm {
+				reply.ConflictIndex--
 			}
 		}
 	}
 
 	reply.Term = this.currentTerm
-	if (aeType == "Heartbeat" && HeartbeatLogs) || aeType == "AppendEntries" {
+	if (aeType == "Heartbeat" && this.cfg.LogHeartbeats) || aeType == "AppendEntries" {
 		this.write_log("Sending %s reply: %+v", aeType, *reply)
 	}
 	return nil
 }
 
+// Handles an incoming RPC InstallSnapshot request
+
+type InstallSnapshotArgs struct {
+	Term     int
+	LeaderId int
+
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	LastConfig        Configuration           // Configuration in effect at LastIncludedIndex
+	Sessions          map[int64]clientSession // Client sessions as of LastIncludedIndex
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+func (this *RaftNode) HandleInstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.state == "Dead" {
+		return nil
+	}
+
+	this.write_log("Received InstallSnapshot from NODE %d; lastIncludedIndex=%d, lastIncludedTerm=%d", args.LeaderId, args.LastIncludedIndex, args.LastIncludedTerm)
+
+	if args.Term > this.currentTerm {
+		this.becomeFollower(args.Term)
+	}
+
+	if args.Term == this.currentTerm {
+		if this.state != "Follower" {
+			this.becomeFollower(args.Term)
+		}
+		this.lastElectionTimerStartedTime = time.Now()
+		this.lastLeaderContact = this.lastElectionTimerStartedTime
+		this.leaderId = args.LeaderId
+
+		// A snapshot of entries we have already committed tells us nothing new
+		if args.LastIncludedIndex > this.lastIncludedIndex && args.LastIncludedIndex > this.commitIndex {
+			this.compactLogUpTo(args.LastIncludedIndex, args.LastIncludedTerm, args.LastConfig)
+			// Those entries are committed, but whether they still hold our proposals the snapshot does not say
+			this.failProposals(0, args.LastIncludedIndex, ErrResultUnknown)
+			if len(this.log) == 0 {
+				this.failProposals(args.LastIncludedIndex+1, math.MaxInt, ErrEntryOverwritten)
+			}
+			this.lastIncludedSessions = copySessions(args.Sessions)
+			this.snapshot = clone(args.Data)
+			this.persistStateAndSnapshot()
+			this.write_log("installed Snapshot; lastIncludedIndex=%d, log=%v", this.lastIncludedIndex, this.log)
+
+			this.commitIndex = args.LastIncludedIndex
+			this.applyCond.Broadcast()
+		}
+	}
+
+	reply.Term = this.currentTerm
+	return nil
+}
+
+// Handles an incoming RPC TimeoutNow request
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+// TimeoutNow RPC. Our leader is handing leadership to us, so start an election without waiting for the timer.
+func (this *RaftNode) HandleTimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.state == "Dead" {
+		return nil
+	}
+
+	this.write_log("Received TimeoutNow from NODE %d; args: %+v", args.LeaderId, args)
+
+	if args.Term > this.currentTerm {
+		this.becomeFollower(args.Term)
+	}
+
+	if args.Term == this.currentTerm && this.state == "Follower" && this.config.isVoter(this.id) {
+		this.startElection(true)
+	}
+
+	reply.Term = this.currentTerm
+	return nil
+}
+
+// Handles an incoming RPC ReadIndex request
+
+type ReadIndexArgs struct {
+	FollowerId int
+}
+
+type ReadIndexReply struct {
+	ReadIndex int
+	Success   bool
+}
+
+// ReadIndex RPC. A follower serving a read asks us, the leader, for an index it must apply up to first.
+func (this *RaftNode) HandleReadIndex(args ReadIndexArgs, reply *ReadIndexReply) error {
+	this.mu.Lock()
+	if this.state == "Dead" {
+		this.mu.Unlock()
+		return nil
+	}
+	this.write_log("Received ReadIndex from NODE %d", args.FollowerId)
+	this.mu.Unlock()
+
+	readIndex, err := this.confirmReadIndex()
+	reply.ReadIndex = readIndex
+	reply.Success = err == nil
+
+	this.write_log("Sending ReadIndex reply: %+v (err=%v)", *reply, err)
+	return nil
+}
+
+// Handles an incoming RPC ForwardCommand request
+
+type ForwardCommandArgs struct {
+	FollowerId int
+	ClientId   int64
+	Sequence   int64
+	Command    interface{}
+}
+
+type ForwardCommandReply struct {
+	Result interface{}
+
+	NotLeader bool
+	LeaderId  int    // Who we think the leader is, if NotLeader
+	Err       string // Any other error
+}
+
+// ForwardCommand RPC. A follower relays a command it was given to us, and the result back to its client.
+func (this *RaftNode) HandleForwardCommand(args ForwardCommandArgs, reply *ForwardCommandReply) error {
+	this.mu.Lock()
+	if this.state == "Dead" {
+		this.mu.Unlock()
+		return nil
+	}
+	this.write_log("Received ForwardCommand from NODE %d: %+v", args.FollowerId, args)
+	this.mu.Unlock()
+
+	// Never forward again, a stale leader hint must not send commands round in circles
+	result, err := this.submitLocally(args.ClientId, args.Sequence, args.Command)
+
+	var notLeader ErrNotLeader
+	if errors.As(err, &notLeader) {
+		reply.NotLeader = true
+		reply.LeaderId = notLeader.LeaderId
+	} else if err != nil {
+		reply.Err = err.Error()
+	} else {
+		reply.Result = result
+	}
+	return nil
+}
+
 // Either handle Command or tell to divert it to Leader
 func (this *RaftNode) ReceiveClientCommand(command interface{}) bool {
+	_, _, isLeader, _ := this.Propose(command)
+	return isLeader
+}
+
+// ReceiveClientCommand for a command that clientId numbered sequence, which is applied at most once.
+func (this *RaftNode) ReceiveClientRequest(clientId int64, sequence int64, command interface{}) bool {
+	_, _, isLeader, _ := this.ProposeInSession(clientId, sequence, command)
+	return isLeader
+}
+
+/* Propose appends command to the log if this node is the leader (and is not handing leadership
+over to another node), and reports the index and term it
+landed at. The returned future resolves with the state machine's result once the entry is applied,
+or fails with ErrEntryOverwritten if a new leader's log replaces it first. If a snapshot from a
+new leader covers the entry before it is applied here, it fails with ErrResultUnknown instead. */
+func (this *RaftNode) Propose(command interface{}) (index int, term int, isLeader bool, future *CommitFuture) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
 
 	this.write_log("ReceiveClientCommand received by %s: %v", this.state, command)
-	if this.state == "Leader" {
-		this.log = append(this.log, LogEntry{Command: command, Term: this.currentTerm})
-		this.write_log("Log=%v", this.log)
-		return true
+	if this.state != "Leader" || this.leadTransferee != -1 {
+		return -1, this.currentTerm, false, nil
+	}
+
+	return this.appendCommand(LogEntry{Command: command, Term: this.currentTerm})
+}
+
+// appendCommand appends a client command on the leader and starts replicating it.
+func (this *RaftNode) appendCommand(entry LogEntry) (index int, term int, isLeader bool, future *CommitFuture) {
+	this.log = append(this.log, entry)
+	this.persist()
+	this.write_log("Log=%v", this.log)
+
+	index, term = this.lastLogIndex(), this.currentTerm
+	future = newCommitFuture(index, term)
+	this.pendingProposals[index] = future
+	this.advanceCommitIndex()
+	this.triggerReplication()
+	return index, term, true, future
+}
+
+/* SubmitCommand proposes command and waits until it is applied, returning the state machine's
+result. A non-zero clientId puts the command in that client's session, see ProposeInSession.
+A follower returns ErrNotLeader naming the leader it knows of, or, if ForwardProposals is set,
+forwards the command to that leader over RPC and relays its answer. */
+func (this *RaftNode) SubmitCommand(clientId int64, sequence int64, command interface{}) (interface{}, error) {
+	result, err := this.submitLocally(clientId, sequence, command)
+
+	var notLeader ErrNotLeader
+	if !errors.As(err, &notLeader) {
+		return result, err
+	}
+	this.mu.Lock()
+	forward, ctx := this.cfg.ForwardProposals, this.stateCtx
+	this.mu.Unlock()
+	if !forward || notLeader.LeaderId == -1 {
+		return nil, err
+	}
+
+	args := ForwardCommandArgs{
+		FollowerId: this.id,
+		ClientId:   clientId,
+		Sequence:   sequence,
+		Command:    command,
+	}
+	this.write_log("forwarding command to leader %d: %+v", notLeader.LeaderId, args)
+
+	var reply ForwardCommandReply
+	if err := this.call(ctx, notLeader.LeaderId, "RaftNode.ForwardCommand", args, &reply); err != nil {
+		return nil, err
+	}
+	if reply.NotLeader {
+		return nil, ErrNotLeader{LeaderId: reply.LeaderId}
+	}
+	if reply.Err != "" {
+		return nil, remoteError(reply.Err)
+	}
+	return reply.Result, nil
+}
+
+// submitLocally is SubmitCommand without forwarding.
+func (this *RaftNode) submitLocally(clientId int64, sequence int64, command interface{}) (interface{}, error) {
+	var isLeader bool
+	var future *CommitFuture
+	if clientId == 0 {
+		_, _, isLeader, future = this.Propose(command)
+	} else {
+		_, _, isLeader, future = this.ProposeInSession(clientId, sequence, command)
+	}
+
+	if !isLeader {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		if this.state == "Leader" {
+			return nil, ErrTransferInProgress
+		}
+		return nil, this.notLeader()
+	}
+
+	select {
+	case <-future.Done():
+		return future.Result()
+	case <-time.After(this.cfg.ProposalTimeout):
+		return nil, ErrCommitTimeout
+	}
+}
+
+// remoteError turns an error message relayed over RPC back into the error it came from, where we know it.
+func remoteError(message string) error {
+	for _, err := range []error{ErrEntryOverwritten, ErrResultUnknown, ErrNodeKilled, ErrTransferInProgress, ErrStaleSequence, ErrCommitTimeout} {
+		if err.Error() == message {
+			return err
+		}
 	}
-	return false
+	return errors.New(message)
 }
@@ -0,0 +1,122 @@
+package raft
+
+import "errors"
+
+var ErrStaleSequence = errors.New("raft: client has already moved past this sequence number")
+
+/* Client sessions give commands exactly-once semantics. A client picks a unique, non-zero ClientId
+and numbers its commands 1, 2, 3, ... with one outstanding at a time, retrying a command with the
+same Sequence until it gets an answer. Every node keeps, for each client, the last Sequence it
+applied and the state machine's result for it. A command whose Sequence has already been applied
+is not applied again, and its retry is answered with the cached result instead. The table is
+built in the apply path, so it is the same on every node, and travels with the snapshot. */
+
+type clientSession struct {
+	Sequence int64       // Last sequence number applied for the client
+	Result   interface{} // What the state machine returned for it; concrete types must be gob-registered
+	Index    int         // Log index it was applied at
+}
+
+// sessionChange records the session of ClientId before the entry at Index was applied.
+type sessionChange struct {
+	Index    int
+	ClientId int64
+	Previous clientSession
+	Existed  bool // Whether ClientId had a session before at all
+}
+
+/* ProposeInSession is Propose for a command that clientId numbered sequence. If that command has
+already been applied, nothing is appended and the returned future holds the cached result;
+index is then that of the entry that applied it. */
+func (this *RaftNode) ProposeInSession(clientId int64, sequence int64, command interface{}) (index int, term int, isLeader bool, future *CommitFuture) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.write_log("ProposeInSession received by %s: client=%d, sequence=%d, %v", this.state, clientId, sequence, command)
+	if this.state != "Leader" || this.leadTransferee != -1 {
+		return -1, this.currentTerm, false, nil
+	}
+
+	if session, ok := this.sessions[clientId]; ok && sequence <= session.Sequence {
+		future = newCommitFuture(session.Index, this.currentTerm)
+		if sequence == session.Sequence {
+			future.resolve(session.Result, nil)
+		} else {
+			future.resolve(nil, ErrStaleSequence)
+		}
+		return future.index, future.term, true, future
+	}
+
+	return this.appendCommand(LogEntry{Command: command, Term: this.currentTerm, ClientId: clientId, Sequence: sequence})
+}
+
+/* Maintenance of the sessions table by the apply path, all called with this.mu held */
+
+// findDuplicates reports which of entries, the next ones to apply, repeat a command applied before them.
+func (this *RaftNode) findDuplicates(entries []LogEntry) []bool {
+	latest := make(map[int64]int64)
+	duplicates := make([]bool, len(entries))
+	for i, entry := range entries {
+		if entry.Type != EntryCommand || entry.ClientId == 0 {
+			continue
+		}
+		seen, ok := latest[entry.ClientId]
+		if !ok {
+			seen = this.sessions[entry.ClientId].Sequence
+		}
+		if entry.Sequence <= seen {
+			duplicates[i] = true
+		} else {
+			latest[entry.ClientId] = entry.Sequence
+		}
+	}
+	return duplicates
+}
+
+// recordSession notes that entry was applied at index with result. For a duplicate it returns the cached result instead.
+func (this *RaftNode) recordSession(index int, entry LogEntry, duplicate bool, result interface{}) interface{} {
+	if entry.Type != EntryCommand || entry.ClientId == 0 {
+		return result
+	}
+	if duplicate {
+		if session := this.sessions[entry.ClientId]; session.Sequence == entry.Sequence {
+			return session.Result
+		}
+		return nil
+	}
+	previous, existed := this.sessions[entry.ClientId]
+	this.sessionHistory = append(this.sessionHistory, sessionChange{Index: index, ClientId: entry.ClientId, Previous: previous, Existed: existed})
+	this.sessions[entry.ClientId] = clientSession{Sequence: entry.Sequence, Result: result, Index: index}
+	return result
+}
+
+// sessionsAt returns the sessions table as it was once index was applied, for lastIncludedIndex <= index <= lastApplied.
+func (this *RaftNode) sessionsAt(index int) map[int64]clientSession {
+	sessions := copySessions(this.sessions)
+	for i := len(this.sessionHistory) - 1; i >= 0 && this.sessionHistory[i].Index > index; i-- {
+		change := this.sessionHistory[i]
+		if change.Existed {
+			sessions[change.ClientId] = change.Previous
+		} else {
+			delete(sessions, change.ClientId)
+		}
+	}
+	return sessions
+}
+
+// forgetSessionHistoryUpTo drops the changes made by entries up to index, once a snapshot holds them.
+func (this *RaftNode) forgetSessionHistoryUpTo(index int) {
+	dropped := 0
+	for dropped < len(this.sessionHistory) && this.sessionHistory[dropped].Index <= index {
+		dropped++
+	}
+	this.sessionHistory = append([]sessionChange(nil), this.sessionHistory[dropped:]...)
+}
+
+func copySessions(sessions map[int64]clientSession) map[int64]clientSession {
+	copied := make(map[int64]clientSession, len(sessions))
+	for clientId, session := range sessions {
+		copied[clientId] = session
+	}
+	return copied
+}
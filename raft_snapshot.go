@@ -0,0 +1,71 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+)
+
+// Snapshot is called once the state machine state up to and including index has been captured in snapshot.
+// The log up to index is discarded; followers that still need those entries are sent the snapshot instead.
+func (this *RaftNode) Snapshot(index int, snapshot []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.takeSnapshot(index, snapshot)
+}
+
+// takeSnapshot is Snapshot for callers that already hold this.mu.
+func (this *RaftNode) takeSnapshot(index int, snapshot []byte) {
+	if index <= this.lastIncludedIndex || index > this.lastApplied {
+		this.write_log("ignoring Snapshot at index %d; lastIncludedIndex=%d, lastApplied=%d", index, this.lastIncludedIndex, this.lastApplied)
+		return
+	}
+
+	// The apply loop may have run ahead of the application; the sessions must be those as of index
+	this.lastIncludedSessions = this.sessionsAt(index)
+	this.forgetSessionHistoryUpTo(index)
+	this.compactLogUpTo(index, this.logTerm(index), this.configurationAt(index))
+	this.snapshot = clone(snapshot)
+	this.persistStateAndSnapshot()
+	this.write_log("took Snapshot; lastIncludedIndex=%d, lastIncludedTerm=%d, log=%v", this.lastIncludedIndex, this.lastIncludedTerm, this.log)
+}
+
+// compactLogUpTo drops every entry up to and including index, which now belongs to a snapshot
+// taken under config. Entries after index are kept only if our log agrees with the snapshot at index.
+func (this *RaftNode) compactLogUpTo(index int, term int, config Configuration) {
+	var remaining []LogEntry
+	if index < this.lastLogIndex() && this.logTerm(index) == term {
+		remaining = append(remaining, this.logSlice(index+1, this.lastLogIndex()+1)...)
+	}
+
+	this.log = remaining
+	this.lastIncludedIndex = index
+	this.lastIncludedTerm = term
+	this.lastIncludedConfig = config
+	this.refreshConfiguration()
+}
+
+// The persisted snapshot carries its own index, term, configuration and client sessions, so a
+// snapshot that was saved without its matching raft state can still be recognised on startup.
+
+func encodeSnapshot(index int, term int, config Configuration, sessions map[int64]clientSession, data []byte) []byte {
+	buffer := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buffer)
+	if encoder.Encode(index) != nil || encoder.Encode(term) != nil || encoder.Encode(config) != nil ||
+		encoder.Encode(sessions) != nil || encoder.Encode(data) != nil {
+		log.Fatalf("could not encode snapshot at index %d", index)
+	}
+	return buffer.Bytes()
+}
+
+func decodeSnapshot(snapshot []byte) (index int, term int, config Configuration, sessions map[int64]clientSession, data []byte) {
+	decoder := gob.NewDecoder(bytes.NewBuffer(snapshot))
+	if decoder.Decode(&index) != nil || decoder.Decode(&term) != nil || decoder.Decode(&config) != nil ||
+		decoder.Decode(&sessions) != nil || decoder.Decode(&data) != nil {
+		log.Fatalf("persisted snapshot is corrupt")
+	}
+	if sessions == nil {
+		sessions = make(map[int64]clientSession)
+	}
+	return index, term, config, sessions, data
+}
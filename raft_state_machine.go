@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// StateMachine is the replicated application that committed log entries are applied to.
+// A RaftNode applies entries one at a time, in log order, from a single goroutine.
+type StateMachine interface {
+	// Apply executes the entry committed at index and returns its result.
+	Apply(index int, entry LogEntry) interface{}
+
+	// Snapshot captures the state built by every entry applied so far.
+	Snapshot() ([]byte, error)
+
+	// Restore throws away the current state and replaces it with a snapshot.
+	Restore(snapshot []byte) error
+}
+
+// A QueryableStateMachine can also answer read-only queries, which RaftNode.Read serves
+// without going through the log. Query may run concurrently with Apply.
+type QueryableStateMachine interface {
+	StateMachine
+
+	// Query returns the answer to query from the state built by the entries applied so far.
+	Query(query interface{}) (interface{}, error)
+}
+
+/* FileStateMachine "applies" a command by appending it to a file,
+so that the queries accepted by the leader can be observed as output */
+
+type FileStateMachine struct {
+	mu       sync.Mutex
+	filePath string
+}
+
+func NewFileStateMachine(filePath string) *FileStateMachine {
+	this := new(FileStateMachine)
+	this.filePath = filePath
+
+	f, _ := os.Create(this.filePath)
+	f.Close()
+
+	return this
+}
+
+func (this *FileStateMachine) Apply(index int, entry LogEntry) interface{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	f, _ := os.OpenFile(this.filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	defer f.Close()
+
+	strentry := fmt.Sprintf("%s; T:[%d]; I:[%d]", entry.Command, entry.Term, index)
+	f.WriteString(strentry)
+	f.WriteString("\n")
+	return strentry
+}
+
+func (this *FileStateMachine) Snapshot() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return os.ReadFile(this.filePath)
+}
+
+func (this *FileStateMachine) Restore(snapshot []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return os.WriteFile(this.filePath, snapshot, 0644)
+}
+
+// Query returns every line applied so far that contains query, a string.
+func (this *FileStateMachine) Query(query interface{}) (interface{}, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	substr, ok := query.(string)
+	if !ok {
+		return nil, fmt.Errorf("FileStateMachine: cannot answer query %v of type %T", query, query)
+	}
+	contents, err := os.ReadFile(this.filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line != "" && strings.Contains(line, substr) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
@@ -1,7 +1,11 @@
 package raft
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func Test1a(t *testing.T) { // Simple Leader Election
@@ -180,3 +184,1277 @@ func Test4(t *testing.T) {
 	//Old leader becomes follower and gets all the Log Entries
 
 }
+
+func Test5(t *testing.T) {
+	/* Persistence Scenario: a follower and then the leader crash and restart;
+	both must come back with the term and log they had persisted. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(origLeaderId, "Set X = 5")
+	cluster.SubmitClientCommand(origLeaderId, "Set X = X+1")
+	sleepMs(3000)
+
+	followerId := (origLeaderId + 1) % 5
+	_, termBeforeCrash, _ := cluster.nodes[followerId].raftLogic.GetNodeState()
+
+	cluster.CrashPeer(followerId)
+	cluster.RestartPeer(followerId)
+
+	restarted := cluster.nodes[followerId].raftLogic
+	restarted.mu.Lock()
+	if restarted.currentTerm < termBeforeCrash || len(restarted.log) != 3 {
+		t.Errorf("restarted node has term=%d log=%v; want term>=%d and 3 entries", restarted.currentTerm, restarted.log, termBeforeCrash)
+	}
+	restarted.mu.Unlock()
+
+	cluster.RestartPeer(origLeaderId)
+
+	newLeaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(newLeaderId, "Set Y = 7")
+	sleepMs(3000)
+
+	restarted = cluster.nodes[origLeaderId].raftLogic
+	restarted.mu.Lock()
+	if len(restarted.log) != 5 { // Each leader starts its term with a no-op
+		t.Errorf("restarted leader has log=%v; want 5 entries", restarted.log)
+	}
+	restarted.mu.Unlock()
+}
+
+func TestFilePersister(t *testing.T) {
+	persister, err := NewFilePersister(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := persister.ReadRaftState(); err != nil || state != nil {
+		t.Fatalf("fresh persister returned state=%v err=%v", state, err)
+	}
+	if err := persister.SaveRaftState([]byte("state")); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := persister.ReadRaftState(); err != nil || string(state) != "state" {
+		t.Fatalf("got state=%q err=%v; want %q", state, err, "state")
+	}
+}
+
+func Test6(t *testing.T) {
+	/* Log Compaction Scenario: a follower crashes, the leader commits and snapshots
+	its log; when the follower comes back it must be sent the snapshot. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	followerId := (leaderId + 1) % 5
+	cluster.CrashPeer(followerId)
+
+	cluster.SubmitClientCommand(leaderId, "Set X = 1")
+	cluster.SubmitClientCommand(leaderId, "Set X = 2")
+	cluster.SubmitClientCommand(leaderId, "Set X = 3")
+	sleepMs(3000)
+
+	leader := cluster.nodes[leaderId].raftLogic
+	leader.mu.Lock()
+	snapshotIndex := leader.lastApplied
+	leader.mu.Unlock()
+	if snapshotIndex != 3 { // The leader's no-op comes first
+		t.Fatalf("leader applied up to %d; want 3", snapshotIndex)
+	}
+	leader.Snapshot(snapshotIndex, []byte("X = 3"))
+
+	cluster.RestartPeer(followerId)
+	cluster.SubmitClientCommand(leaderId, "Set X = 4")
+	sleepMs(3000)
+
+	follower := cluster.nodes[followerId].raftLogic
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	if follower.lastIncludedIndex != snapshotIndex || string(follower.snapshot) != "X = 3" {
+		t.Errorf("follower has lastIncludedIndex=%d snapshot=%q; want %d and %q", follower.lastIncludedIndex, follower.snapshot, snapshotIndex, "X = 3")
+	}
+	if follower.lastApplied != 4 || len(follower.log) != 1 {
+		t.Errorf("follower has lastApplied=%d log=%v; want 4 and one entry", follower.lastApplied, follower.log)
+	}
+}
+
+func Test7(t *testing.T) {
+	/* State Machine Scenario: nodes snapshot their state machine on their own;
+	a restarted follower must restore it from the snapshot and catch up. */
+
+	config := DefaultConfig()
+	config.SnapshotThreshold = 2
+	cluster := NewClusterWithConfig(t, 5, config)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(leaderId, "Set X = 1")
+	cluster.SubmitClientCommand(leaderId, "Set X = 2")
+	cluster.SubmitClientCommand(leaderId, "Set X = 3")
+	sleepMs(3000)
+
+	followerId := (leaderId + 1) % 5
+	before, _ := cluster.nodes[followerId].stateMachine.Snapshot()
+
+	cluster.RestartPeer(followerId)
+	sleepMs(3000)
+
+	follower := cluster.nodes[followerId].raftLogic
+	follower.mu.Lock()
+	if follower.lastIncludedIndex < 1 || follower.lastApplied != 3 {
+		t.Errorf("restarted follower has lastIncludedIndex=%d lastApplied=%d; want >=1 and 3", follower.lastIncludedIndex, follower.lastApplied)
+	}
+	follower.mu.Unlock()
+
+	after, _ := cluster.nodes[followerId].stateMachine.Snapshot()
+	if string(before) != string(after) {
+		t.Errorf("restarted follower state machine is %q; want %q", after, before)
+	}
+}
+
+func Test8(t *testing.T) {
+	/* Apply Channel Scenario: every node must deliver the committed commands
+	on its apply channel, in log order. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	commands := []interface{}{"Set X = 1", "Set Y = 2", "Set X = X+Y"}
+	for _, cmd := range commands {
+		cluster.SubmitClientCommand(leaderId, cmd)
+	}
+	sleepMs(3000)
+
+	for i := 0; i < 5; i++ {
+		applied := cluster.getAppliedCommands(i)
+		if !reflect.DeepEqual(applied, commands) {
+			t.Errorf("node %d applied %v; want %v", i, applied, commands)
+		}
+	}
+}
+
+func Test9(t *testing.T) {
+	/* Commit Future Scenario: a proposal to a connected leader resolves with its
+	result; a proposal to a leader that drops before replicating it fails once
+	the new leader's log overwrites it. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	index, _, isLeader, committed := cluster.nodes[origLeaderId].raftLogic.Propose("Set X = 1")
+	if !isLeader || index != 1 { // After the leader's no-op
+		t.Fatalf("Propose returned index=%d isLeader=%v; want 1 and true", index, isLeader)
+	}
+	want := fmt.Sprintf("Set X = 1; T:[%d]; I:[1]", committed.Term())
+	if result, err := waitForCommit(committed); err != nil || result != want {
+		t.Errorf("committed proposal resolved with result=%v err=%v; want %q", result, err, want)
+	}
+
+	_, _, _, overwritten := cluster.nodes[origLeaderId].raftLogic.Propose("Set X = 2")
+	cluster.DisconnectPeer(origLeaderId)
+
+	newLeaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(newLeaderId, "Set X = 3")
+	sleepMs(2000)
+
+	cluster.ReconnectPeer(origLeaderId)
+	if _, err := waitForCommit(overwritten); err != ErrEntryOverwritten {
+		t.Errorf("overwritten proposal resolved with err=%v; want %v", err, ErrEntryOverwritten)
+	}
+}
+
+func waitForCommit(future *CommitFuture) (interface{}, error) {
+	select {
+	case <-future.Done():
+		return future.Result()
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("timed out waiting for commit")
+	}
+}
+
+func isNotLeader(err error) bool {
+	var notLeader ErrNotLeader
+	return errors.As(err, &notLeader)
+}
+
+func Test10(t *testing.T) {
+	/* PreVote Scenario: a follower is partitioned away for longer than any
+	election timeout; it must neither inflate its term nor depose the leader
+	when it comes back. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	_, leaderTerm, _ := cluster.nodes[leaderId].raftLogic.GetNodeState()
+	sleepMs(2000) // Until every follower has heard from the leader; RPCs in flight are lost with the link
+
+	followerId := (leaderId + 1) % 5
+	cluster.DisconnectPeer(followerId)
+	sleepMs(8000)
+
+	if _, term, _ := cluster.nodes[followerId].raftLogic.GetNodeState(); term != leaderTerm {
+		t.Errorf("partitioned follower moved to term %d; want %d", term, leaderTerm)
+	}
+
+	cluster.ReconnectPeer(followerId)
+	sleepMs(3000)
+
+	if newLeaderId := cluster.getClusterLeader(); newLeaderId != leaderId {
+		t.Errorf("leader changed from %d to %d after the follower came back", leaderId, newLeaderId)
+	}
+	if _, term, _ := cluster.nodes[leaderId].raftLogic.GetNodeState(); term != leaderTerm {
+		t.Errorf("leader moved to term %d; want %d", term, leaderTerm)
+	}
+}
+
+func Test11(t *testing.T) {
+	/* CheckQuorum Scenario: a leader that is partitioned away must step down
+	within an election timeout and stop accepting commands. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	cluster.DisconnectPeer(origLeaderId)
+	sleepMs(5000)
+
+	if _, _, isLeader := cluster.nodes[origLeaderId].raftLogic.GetNodeState(); isLeader {
+		t.Errorf("partitioned node %d still thinks it is the leader", origLeaderId)
+	}
+	if cluster.SubmitClientCommand(origLeaderId, "Set X = X-5") {
+		t.Errorf("partitioned node %d accepted a command", origLeaderId)
+	}
+}
+
+func Test12(t *testing.T) {
+	/* Leadership Transfer Scenario: the leader hands leadership to a follower,
+	which must become the only leader and still hold every entry. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(origLeaderId, "Set X = 5")
+
+	targetId := (origLeaderId + 1) % 5
+	if err := cluster.nodes[origLeaderId].raftLogic.TransferLeadership(targetId); err != nil {
+		t.Fatalf("TransferLeadership(%d) failed: %v", targetId, err)
+	}
+
+	if newLeaderId := cluster.getClusterLeader(); newLeaderId != targetId {
+		t.Errorf("leader is %d after transferring to %d", newLeaderId, targetId)
+	}
+	if !cluster.SubmitClientCommand(targetId, "Set X = X+1") {
+		t.Errorf("new leader %d refused a command", targetId)
+	}
+	sleepMs(4000)
+
+	want := []interface{}{"Set X = 5", "Set X = X+1"}
+	if applied := cluster.getAppliedCommands(origLeaderId); !reflect.DeepEqual(applied, want) {
+		t.Errorf("old leader applied %v; want %v", applied, want)
+	}
+}
+
+func Test13(t *testing.T) {
+	/* Membership Change Scenario: a sixth server joins the cluster, then the
+	leader removes itself; each change must go through the joint configuration
+	and the cluster must keep committing under the new one. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(origLeaderId, "Set X = 1")
+
+	newId := cluster.AddPeer()
+	if err := cluster.nodes[origLeaderId].raftLogic.ChangeConfiguration([]int{0, 1, 2, 3, 4, newId}); err != nil {
+		t.Fatalf("ChangeConfiguration failed: %v", err)
+	}
+	cluster.waitForConfiguration(origLeaderId, []int{0, 1, 2, 3, 4, newId})
+
+	remaining := make([]int, 0)
+	for i := 0; i <= newId; i++ {
+		if i != origLeaderId {
+			remaining = append(remaining, i)
+		}
+	}
+	if err := cluster.nodes[origLeaderId].raftLogic.ChangeConfiguration(remaining); err != nil {
+		t.Fatalf("ChangeConfiguration failed: %v", err)
+	}
+	cluster.waitForConfiguration(origLeaderId, remaining)
+	sleepMs(1000)
+
+	newLeaderId := cluster.getClusterLeader()
+	if newLeaderId == origLeaderId {
+		t.Fatalf("removed node %d is still the leader", origLeaderId)
+	}
+	cluster.SubmitClientCommand(newLeaderId, "Set X = 2")
+	sleepMs(3000)
+
+	want := []interface{}{"Set X = 1", "Set X = 2"}
+	if applied := cluster.getAppliedCommands(newId); !reflect.DeepEqual(applied, want) {
+		t.Errorf("added node %d applied %v; want %v", newId, applied, want)
+	}
+}
+
+func Test14(t *testing.T) {
+	/* Learner Scenario: a sixth server joins as a learner and catches up without
+	becoming a voter, then is promoted through a configuration change. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	cluster.SubmitClientCommand(leaderId, "Set X = 1")
+
+	learnerId := cluster.AddPeer()
+	if err := cluster.nodes[leaderId].raftLogic.AddLearner(learnerId); err != nil {
+		t.Fatalf("AddLearner failed: %v", err)
+	}
+	cluster.SubmitClientCommand(leaderId, "Set X = 2")
+	sleepMs(4000)
+
+	want := []interface{}{"Set X = 1", "Set X = 2"}
+	if applied := cluster.getAppliedCommands(learnerId); !reflect.DeepEqual(applied, want) {
+		t.Errorf("learner %d applied %v; want %v", learnerId, applied, want)
+	}
+	if config, _ := cluster.nodes[learnerId].raftLogic.GetConfiguration(); config.isVoter(learnerId) || !config.isLearner(learnerId) {
+		t.Errorf("learner %d sees configuration %+v", learnerId, config)
+	}
+
+	if err := cluster.nodes[leaderId].raftLogic.ChangeConfiguration([]int{0, 1, 2, 3, 4, learnerId}); err != nil {
+		t.Fatalf("ChangeConfiguration failed: %v", err)
+	}
+	cluster.waitForConfiguration(leaderId, []int{0, 1, 2, 3, 4, learnerId})
+	if config, _ := cluster.nodes[leaderId].raftLogic.GetConfiguration(); len(config.Learners) != 0 {
+		t.Errorf("promoted learner still listed in %+v", config)
+	}
+}
+
+func Test15(t *testing.T) {
+	/* Fast Backtracking Scenario: a partitioned leader piles up a long run of
+	entries that never commit. It comes back to a leader elected after the rest
+	of the cluster moved on, whose nextIndex for it starts past that whole run;
+	its log must be repaired in a couple of heartbeats rather than one round per
+	divergent entry. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	commands := []interface{}{"Set X = 0"}
+	cluster.SubmitClientCommand(origLeaderId, commands[0])
+	sleepMs(3000)
+
+	cluster.DisconnectPeer(origLeaderId)
+	for i := 0; i < 30; i++ {
+		cluster.SubmitClientCommand(origLeaderId, fmt.Sprintf("Set Y = %d", i))
+	}
+
+	secondLeaderId := cluster.getClusterLeader()
+	for i := 0; i < 30; i++ {
+		cmd := fmt.Sprintf("Set X = %d", i+1)
+		cluster.SubmitClientCommand(secondLeaderId, cmd)
+		commands = append(commands, cmd)
+	}
+	sleepMs(3000)
+
+	cluster.DisconnectPeer(secondLeaderId)
+	thirdLeaderId := cluster.getClusterLeader()
+	cluster.ReconnectPeer(origLeaderId)
+	sleepMs(5000)
+
+	applied := cluster.getAppliedCommands(origLeaderId)
+	if !reflect.DeepEqual(applied, commands) {
+		t.Errorf("reconnected node %d applied %v under leader %d; want %v", origLeaderId, applied, thirdLeaderId, commands)
+	}
+}
+
+func Test16(t *testing.T) {
+	/* Pipelining Scenario: commands proposed back to back are replicated as soon
+	as they are appended, without waiting for the next heartbeat, and every node
+	ends up applying them once each, in order. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	sleepMs(1500) // Let the first round of heartbeats settle
+
+	commands := make([]interface{}, 0)
+	var last *CommitFuture
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		cmd := fmt.Sprintf("Set X = %d", i)
+		_, _, isLeader, future := cluster.nodes[leaderId].raftLogic.Propose(cmd)
+		if !isLeader {
+			t.Fatalf("node %d stopped being leader", leaderId)
+		}
+		commands = append(commands, cmd)
+		last = future
+	}
+	// Replicated as they are appended, they commit well within two heartbeat intervals, even over a slow network
+	deadline := 2 * cluster.config.HeartbeatInterval
+	select {
+	case <-last.Done():
+		if _, err := last.Result(); err != nil {
+			t.Fatalf("last proposal failed: %v", err)
+		}
+	case <-time.After(deadline - time.Since(start)):
+		t.Errorf("20 proposals did not commit within %v; want them replicated without waiting on heartbeats", deadline)
+	}
+
+	for i := 0; i < 5; i++ {
+		if applied := cluster.waitForAppliedCommands(i, commands, 5000); !reflect.DeepEqual(applied, commands) {
+			t.Errorf("node %d applied %v; want %v", i, applied, commands)
+		}
+	}
+}
+
+func Test17(t *testing.T) {
+	/* Batching Scenario: with small per-request limits, a follower that missed
+	many entries is brought up to date over several capped AppendEntries. */
+
+	config := DefaultConfig()
+	config.MaxEntriesPerAppend = 3
+	config.MaxBytesPerAppend = 2*commandSize("Set X = 0") + 1 // Room for two commands
+	cluster := NewClusterWithConfig(t, 5, config)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	followerId := (leaderId + 1) % 5
+	cluster.CrashPeer(followerId)
+
+	commands := make([]interface{}, 0)
+	for i := 0; i < 20; i++ {
+		cmd := fmt.Sprintf("Set X = %d", i)
+		cluster.SubmitClientCommand(leaderId, cmd)
+		commands = append(commands, cmd)
+	}
+	sleepMs(2000)
+
+	leader := cluster.nodes[leaderId].raftLogic
+	leader.mu.Lock()
+	batch, probe := leader.entriesToSend(1, leader.cfg.MaxEntriesPerAppend), leader.entriesToSend(1, 1)
+	leader.mu.Unlock()
+	if len(batch) != 2 || len(probe) != 1 {
+		t.Errorf("batches of %d and %d entries; want 2 under the byte limit and 1 when probing", len(batch), len(probe))
+	}
+
+	cluster.RestartPeer(followerId)
+	sleepMs(5000)
+
+	applied := cluster.getAppliedCommands(followerId)
+	if !reflect.DeepEqual(applied, commands) {
+		t.Errorf("restarted node %d applied %v; want %v", followerId, applied, commands)
+	}
+}
+
+func Test18(t *testing.T) {
+	/* ReadIndex Scenario: the leader serves reads that see every committed write
+	once it has committed in its term, which its no-op lets it do before any
+	client writes; followers and a partitioned leader refuse. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	sleepMs(1500)
+	if result, err := leader.Read("Set X"); err != nil || !reflect.DeepEqual(result, []string{}) {
+		t.Errorf("read before any write returned result=%v err=%v; want no lines", result, err)
+	}
+
+	_, _, _, future := leader.Propose("Set X = 1")
+	written, err := waitForCommit(future)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if result, err := leader.Read("Set X"); err != nil || !reflect.DeepEqual(result, []string{written.(string)}) {
+		t.Errorf("leader read returned result=%v err=%v; want [%v]", result, err, written)
+	}
+
+	followerId := (leaderId + 1) % 5
+	if _, err := cluster.nodes[followerId].raftLogic.Read("Set X"); !isNotLeader(err) {
+		t.Errorf("follower read returned err=%v; want ErrNotLeader", err)
+	}
+
+	cluster.DisconnectPeer(leaderId)
+	if result, err := leader.Read("Set X"); err == nil {
+		t.Errorf("partitioned leader served read %v", result)
+	}
+}
+
+func Test19(t *testing.T) {
+	/* Lease Read Scenario: a leader that has heard from a quorum recently serves
+	reads locally; it stops once the lease runs out or while it hands over leadership. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	_, _, _, future := leader.Propose("Set X = 1")
+	written, err := waitForCommit(future)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	start := time.Now()
+	result, err := leader.LeaseRead("Set X")
+	if err != nil || !reflect.DeepEqual(result, []string{written.(string)}) {
+		t.Errorf("lease read returned result=%v err=%v; want [%v]", result, err, written)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("lease read took %v; want it served without a round trip", elapsed)
+	}
+
+	followerId := (leaderId + 1) % 5
+	if _, err := cluster.nodes[followerId].raftLogic.LeaseRead("Set X"); !isNotLeader(err) {
+		t.Errorf("follower lease read returned err=%v; want ErrNotLeader", err)
+	}
+
+	leader.mu.Lock()
+	leader.leadTransferee = followerId
+	leader.mu.Unlock()
+	if _, err := leader.LeaseRead("Set X"); err != ErrTransferInProgress {
+		t.Errorf("lease read during a transfer returned err=%v; want %v", err, ErrTransferInProgress)
+	}
+	leader.mu.Lock()
+	leader.leadTransferee = -1
+	leader.mu.Unlock()
+
+	cluster.DisconnectPeer(leaderId)
+	time.Sleep(leader.cfg.ElectionTimeoutMin)
+	if result, err := leader.LeaseRead("Set X"); err == nil {
+		t.Errorf("partitioned leader served lease read %v", result)
+	}
+}
+
+func Test20(t *testing.T) {
+	/* Follower Read Scenario: a follower gets a read index from the leader and
+	answers once it has applied up to it, so it sees a write the leader has just
+	committed even before hearing the new commitIndex itself. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	followerId := (leaderId + 1) % 5
+	follower := cluster.nodes[followerId].raftLogic
+
+	want := make([]string, 0)
+	for i := 1; i <= 2; i++ {
+		_, _, _, future := leader.Propose(fmt.Sprintf("Set X = %d", i))
+		written, err := waitForCommit(future)
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		want = append(want, written.(string))
+	}
+
+	if result, err := follower.FollowerRead("Set X"); err != nil || !reflect.DeepEqual(result, want) {
+		t.Errorf("follower read returned result=%v err=%v; want %v", result, err, want)
+	}
+	if result, err := leader.FollowerRead("Set X"); err != nil || !reflect.DeepEqual(result, want) {
+		t.Errorf("leader read returned result=%v err=%v; want %v", result, err, want)
+	}
+
+	cluster.DisconnectPeer(followerId)
+	if result, err := follower.FollowerRead("Set X"); err == nil {
+		t.Errorf("partitioned follower served read %v", result)
+	}
+}
+
+func Test21(t *testing.T) {
+	/* No-op Scenario: an entry from an earlier term that never committed is
+	committed by the next leader's no-op, without waiting for a client command. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	followerId := (origLeaderId + 1) % 5
+	others := []int{(origLeaderId + 2) % 5, (origLeaderId + 3) % 5, (origLeaderId + 4) % 5}
+	sleepMs(1500) // Let everyone commit the first no-op
+
+	// With just one follower the leader can replicate but never commit
+	for _, id := range others {
+		cluster.DisconnectPeer(id)
+	}
+	cluster.SubmitClientCommand(origLeaderId, "Set X = 1")
+	sleepMs(2000)
+	if applied := cluster.getAppliedCommands(origLeaderId); len(applied) != 0 {
+		t.Fatalf("leader without a quorum applied %v", applied)
+	}
+
+	// Only the follower holding the entry can now win an election
+	cluster.DisconnectPeer(origLeaderId)
+	cluster.ReconnectPeer(others[0])
+	cluster.ReconnectPeer(others[1])
+	if newLeaderId := cluster.getClusterLeader(); newLeaderId != followerId {
+		t.Fatalf("node %d became leader; want %d", newLeaderId, followerId)
+	}
+	sleepMs(3000)
+
+	want := []interface{}{"Set X = 1"}
+	for _, id := range []int{followerId, others[0], others[1]} {
+		if applied := cluster.getAppliedCommands(id); !reflect.DeepEqual(applied, want) {
+			t.Errorf("node %d applied %v; want %v", id, applied, want)
+		}
+	}
+}
+
+func Test22(t *testing.T) {
+	/* Client Session Scenario: a command retried with the same sequence number is
+	applied once, whether the retry finds it already applied or still in the log,
+	and a follower that catches up from a snapshot knows about it too. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	followerId := (leaderId + 1) % 5
+	cluster.CrashPeer(followerId)
+
+	_, _, _, first := leader.ProposeInSession(7, 1, "Set X = X+1")
+	result, err := waitForCommit(first)
+	if err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+
+	// A retry of an applied request is answered from the cache, without touching the log
+	leader.mu.Lock()
+	lastIndex := leader.lastLogIndex()
+	leader.mu.Unlock()
+	_, _, _, retry := leader.ProposeInSession(7, 1, "Set X = X+1")
+	if cached, err := waitForCommit(retry); err != nil || cached != result {
+		t.Errorf("retried request resolved with result=%v err=%v; want %v", cached, err, result)
+	}
+	leader.mu.Lock()
+	if leader.lastLogIndex() != lastIndex {
+		t.Errorf("retried request was appended to the log")
+	}
+	leader.mu.Unlock()
+
+	// A retry that lands in the log before the original is applied is skipped when applied
+	_, _, _, second := leader.ProposeInSession(7, 2, "Set X = X*2")
+	_, _, _, secondRetry := leader.ProposeInSession(7, 2, "Set X = X*2")
+	secondResult, err := waitForCommit(second)
+	if retried, retryErr := waitForCommit(secondRetry); err != nil || retryErr != nil || retried != secondResult {
+		t.Errorf("duplicate requests resolved with %v (%v) and %v (%v); want the same result", secondResult, err, retried, retryErr)
+	}
+	sleepMs(2000)
+
+	want := []interface{}{"Set X = X+1", "Set X = X*2"}
+	if applied := cluster.getAppliedCommands(leaderId); !reflect.DeepEqual(applied, want) {
+		t.Errorf("leader applied %v; want %v", applied, want)
+	}
+
+	leader.mu.Lock()
+	snapshotIndex := leader.lastApplied
+	leader.mu.Unlock()
+	leader.Snapshot(snapshotIndex, []byte("X = 2"))
+
+	cluster.RestartPeer(followerId)
+	sleepMs(3000)
+
+	follower := cluster.nodes[followerId].raftLogic
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	if session := follower.sessions[7]; follower.lastIncludedIndex != snapshotIndex || session.Sequence != 2 || session.Result != secondResult {
+		t.Errorf("follower has lastIncludedIndex=%d session=%+v; want %d and sequence 2 with result %v", follower.lastIncludedIndex, session, snapshotIndex, secondResult)
+	}
+}
+
+func Test23(t *testing.T) {
+	/* Forwarding Scenario: a follower refuses what only the leader can do with a
+	hint naming the leader; with forwarding on it relays commands there and
+	returns the leader's result, and a forwarded retry in a session is still
+	applied once. */
+
+	config := DefaultConfig()
+	config.ForwardProposals = true
+	cluster := NewClusterWithConfig(t, 5, config)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	sleepMs(1500) // Let the followers hear from the leader
+	follower := cluster.nodes[(leaderId+1)%5].raftLogic
+
+	_, err := follower.ReadIndex()
+	var notLeader ErrNotLeader
+	if !errors.As(err, &notLeader) || notLeader.LeaderId != leaderId {
+		t.Fatalf("follower returned err=%v; want ErrNotLeader naming %d", err, leaderId)
+	}
+
+	_, term, _ := cluster.nodes[leaderId].raftLogic.GetNodeState()
+	want := fmt.Sprintf("Set X = 1; T:[%d]; I:[1]", term)
+	if result, err := follower.SubmitCommand(0, 0, "Set X = 1"); err != nil || result != want {
+		t.Errorf("forwarded command returned result=%v err=%v; want %q", result, err, want)
+	}
+
+	first, err := follower.SubmitCommand(7, 1, "Set Y = Y+1")
+	retried, retryErr := follower.SubmitCommand(7, 1, "Set Y = Y+1")
+	if err != nil || retryErr != nil || first != retried {
+		t.Errorf("forwarded request and retry returned %v (%v) and %v (%v); want the same result", first, err, retried, retryErr)
+	}
+	sleepMs(2000)
+
+	applied := cluster.getAppliedCommands(leaderId)
+	if wantApplied := []interface{}{"Set X = 1", "Set Y = Y+1"}; !reflect.DeepEqual(applied, wantApplied) {
+		t.Errorf("leader applied %v; want %v", applied, wantApplied)
+	}
+}
+
+func Test24(t *testing.T) {
+	/* Config Scenario: a cluster started with short timeouts elects a leader,
+	replaces it and commits in a fraction of the default election timeout, and
+	a server is not started with a config that cannot work. */
+
+	config := DefaultConfig()
+	config.ElectionTimeoutMin = 300 * time.Millisecond
+	config.ElectionTimeoutMax = 600 * time.Millisecond
+	config.HeartbeatInterval = 100 * time.Millisecond
+	config.TickInterval = 50 * time.Millisecond
+	config.MaxClockDrift = 30 * time.Millisecond
+
+	cluster := NewClusterWithConfig(t, 5, config)
+	defer cluster.Shutdown()
+	cluster.SetNetworkFaults(LinkFaults{MinDelay: 5 * time.Millisecond, MaxDelay: 5 * time.Millisecond})
+
+	start := time.Now()
+	firstLeaderId := cluster.getClusterLeader()
+	cluster.DisconnectPeer(firstLeaderId)
+	secondLeaderId := cluster.getClusterLeader()
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Errorf("two elections took %v with a %v election timeout", elapsed, config.ElectionTimeoutMax)
+	}
+
+	leader := cluster.nodes[secondLeaderId].raftLogic
+	leader.mu.Lock()
+	term, index := leader.currentTerm, leader.lastLogIndex()+1
+	leader.mu.Unlock()
+	result, err := leader.SubmitCommand(0, 0, "Set X = 1")
+	if want := fmt.Sprintf("Set X = 1; T:[%d]; I:[%d]", term, index); err != nil || result != want {
+		t.Errorf("command returned result=%v err=%v; want %q", result, err, want)
+	}
+
+	bad := config
+	bad.HeartbeatInterval = config.ElectionTimeoutMin
+	if _, err := NewServer(5, nil, nil, bad, NewMemoryNetwork().NewTransport(), NewMemoryPersister(), nil, nil); err == nil {
+		t.Errorf("NewServer accepted a heartbeat interval as long as the election timeout")
+	}
+	if _, err := NewRaftNode(5, nil, NewMemoryNetwork().NewTransport(), Config{}, NewMemoryPersister(), nil, nil, nil); err == nil {
+		t.Errorf("NewRaftNode accepted the zero Config")
+	}
+	bad = config
+	bad.ProposalTimeout = 0
+	if _, err := NewRaftNode(5, nil, NewMemoryNetwork().NewTransport(), bad, NewMemoryPersister(), nil, nil, nil); err == nil {
+		t.Errorf("NewRaftNode accepted a zero ProposalTimeout")
+	}
+}
+
+func Test25(t *testing.T) {
+	/* Transport Scenario: the scenarios above run on in-memory transports; the
+	same cluster over net/rpc and TCP elects, commits, and fails over too. */
+
+	cluster := NewClusterWithTransport(t, 3, DefaultConfig(), func() Transport { return NewTCPTransport(":0") })
+	defer cluster.Shutdown()
+
+	origLeaderId := cluster.getClusterLeader()
+	result, err := cluster.nodes[origLeaderId].raftLogic.SubmitCommand(0, 0, "Set X = 1")
+	if err != nil {
+		t.Fatalf("command over TCP failed: %v", err)
+	}
+
+	cluster.DisconnectPeer(origLeaderId)
+	newLeaderId := cluster.getClusterLeader()
+	sleepMs(1500)
+	if applied := cluster.getAppliedCommands(newLeaderId); !reflect.DeepEqual(applied, []interface{}{"Set X = 1"}) {
+		t.Errorf("new leader applied %v after %v; want the command", applied, result)
+	}
+}
+
+func Test26(t *testing.T) {
+	/* Hung Peer Scenario: a follower that stops answering without dropping its
+	connection costs the leader timed-out AppendEntries, not stuck ones, and
+	commits carry on without it; once too many hang, the leader steps down and
+	gives up on what it still had outstanding. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	first, second := cluster.nodes[(leaderId+1)%3].raftLogic, cluster.nodes[(leaderId+2)%3].raftLogic
+
+	first.mu.Lock() // Its RPC handlers now block
+	if _, err := leader.SubmitCommand(0, 0, "Set X = 1"); err != nil {
+		t.Errorf("command with one follower hung failed: %v", err)
+	}
+	sleepMs(4000)
+	if stats := leader.RPCStats()["AppendEntries"]; stats.TimedOut == 0 {
+		t.Errorf("no AppendEntries to the hung follower timed out: %+v", stats)
+	}
+
+	second.mu.Lock()
+	for i := 0; i < 20; i++ {
+		if _, _, isLeader := leader.GetNodeState(); !isLeader {
+			break
+		}
+		sleepMs(500)
+	}
+	if _, _, isLeader := leader.GetNodeState(); isLeader {
+		t.Errorf("leader kept leading with both followers hung")
+	}
+	if stats := leader.RPCStats()["AppendEntries"]; stats.Cancelled == 0 {
+		t.Errorf("stepping down left AppendEntries outstanding: %+v", stats)
+	}
+	first.mu.Unlock()
+	second.mu.Unlock()
+}
+
+func Test27(t *testing.T) {
+	/* Reconnect Scenario: when the leader's TCP connection to a follower breaks
+	under it, the leader redials the follower by itself, without the cluster
+	connecting them again, and the follower catches up on what it missed. */
+
+	cluster := NewClusterWithTransport(t, 3, DefaultConfig(), func() Transport { return NewTCPTransport(":0") })
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	followerId := (leaderId + 1) % 3
+	transport := cluster.nodes[leaderId].transport.(*FaultyTransport).Transport.(*TCPTransport)
+
+	transport.mu.Lock()
+	transport.peers[followerId].client.Close()
+	transport.mu.Unlock()
+
+	if _, err := cluster.nodes[leaderId].raftLogic.SubmitCommand(0, 0, "Set X = 1"); err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	sleepMs(3000)
+
+	if status := cluster.nodes[leaderId].PeerStatus()[followerId]; status.State != "Connected" {
+		t.Errorf("leader did not reconnect to follower %d: %+v", followerId, status)
+	}
+	if applied := cluster.getAppliedCommands(followerId); !reflect.DeepEqual(applied, []interface{}{"Set X = 1"}) {
+		t.Errorf("follower applied %v after reconnecting; want the command", applied)
+	}
+}
+
+func Test28(t *testing.T) {
+	/* Lossy Network Scenario: with every link dropping, duplicating and
+	reordering RPCs, and the link out of one follower dropping nearly all of
+	them, commands still commit, and every server applies each one exactly
+	once and in order. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	cluster.SetNetworkFaults(LinkFaults{MinDelay: 10 * time.Millisecond, MaxDelay: 200 * time.Millisecond, DropRate: 0.1, DuplicateRate: 0.3, ReorderRate: 0.3})
+	lossyId := (leaderId + 1) % 3
+	cluster.SetLinkFaults(lossyId, leaderId, LinkFaults{DropRate: 0.9})
+
+	want := make([]interface{}, 0)
+	for i := 0; i < 5; i++ {
+		command := fmt.Sprintf("Set X = %d", i)
+		if _, err := cluster.nodes[leaderId].raftLogic.SubmitCommand(7, int64(i+1), command); err != nil {
+			t.Fatalf("command %d failed on the lossy network: %v", i, err)
+		}
+		want = append(want, command)
+	}
+
+	cluster.ClearLinkFaults()
+	cluster.SetNetworkFaults(testNetworkFaults())
+	sleepMs(4000)
+	for id := 0; id < 3; id++ {
+		if applied := cluster.getAppliedCommands(id); !reflect.DeepEqual(applied, want) {
+			t.Errorf("server %d applied %v; want %v", id, applied, want)
+		}
+	}
+}
+
+func Test29(t *testing.T) {
+	/* Partition Scenario: with the leader split off into a minority, the
+	majority elects a leader of its own and commits without it, while the old
+	leader commits nothing; once healed, the old side applies what the
+	majority committed. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	minority := []int{leaderId, (leaderId + 1) % 5}
+	majority := []int{(leaderId + 2) % 5, (leaderId + 3) % 5, (leaderId + 4) % 5}
+	cluster.Partition(minority, majority)
+
+	oldLeader := cluster.nodes[leaderId].raftLogic
+	if _, _, isLeader, _ := oldLeader.Propose("Set X = 1"); !isLeader {
+		t.Fatalf("old leader refused a proposal right after the partition")
+	}
+
+	sleepMs(7000)
+	newLeaderId := cluster.getGroupLeader(majority)
+	if _, err := cluster.nodes[newLeaderId].raftLogic.SubmitCommand(0, 0, "Set Y = 2"); err != nil {
+		t.Fatalf("majority failed to commit: %v", err)
+	}
+	if _, _, isLeader := oldLeader.GetNodeState(); isLeader {
+		t.Errorf("old leader still leads a minority")
+	}
+
+	cluster.Heal()
+	want := []interface{}{"Set Y = 2"}
+	for id := 0; id < 5; id++ {
+		if applied := cluster.waitForAppliedCommands(id, want, 10000); !reflect.DeepEqual(applied, want) {
+			t.Errorf("server %d applied %v; want only the majority's command", id, applied)
+		}
+	}
+}
+
+func Test30(t *testing.T) {
+	/* One-Way Scenario: a leader whose heartbeats reach its followers but
+	never hears back from them steps down, and the followers elect one of
+	themselves even though the old leader kept them quiet until then. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	followers := []int{(leaderId + 1) % 3, (leaderId + 2) % 3}
+	for _, followerId := range followers {
+		cluster.CutLink(followerId, leaderId)
+	}
+
+	sleepMs(12000)
+	if _, _, isLeader := cluster.nodes[leaderId].raftLogic.GetNodeState(); isLeader {
+		t.Errorf("leader kept leading without hearing from its followers")
+	}
+	newLeaderId := cluster.getGroupLeader(followers)
+	if _, err := cluster.nodes[newLeaderId].raftLogic.SubmitCommand(0, 0, "Set X = 1"); err != nil {
+		t.Errorf("followers' leader failed to commit: %v", err)
+	}
+
+	cluster.Heal()
+	// A probe to the old leader lost to the cut is only given up on after its AppendEntries timeout
+	want := []interface{}{"Set X = 1"}
+	if applied := cluster.waitForAppliedCommands(leaderId, want, 10000); !reflect.DeepEqual(applied, want) {
+		t.Errorf("old leader applied %v after healing; want the command", applied)
+	}
+	cluster.getClusterLeader() // Fails if the old leader came back as a second one
+}
+
+func Test31(t *testing.T) {
+	/* Failed Transfer Scenario: a leader cut off from the rest steps down
+	through CheckQuorum in the middle of a leadership transfer; the transfer
+	must report that it failed rather than that it is done. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	targetId := (leaderId + 1) % 3
+	cluster.Partition([]int{leaderId}, []int{targetId, (leaderId + 2) % 3})
+	sleepMs(1500)
+
+	if err := cluster.nodes[leaderId].raftLogic.TransferLeadership(targetId); err == nil {
+		t.Errorf("transfer from a leader cut off from its target succeeded")
+	}
+	if _, _, isLeader := cluster.nodes[leaderId].raftLogic.GetNodeState(); isLeader {
+		t.Errorf("leader cut off from a quorum kept leading")
+	}
+}
+
+func Test32(t *testing.T) {
+	/* Bad Configuration Scenario: the leader refuses configurations that could
+	never form a majority, and changes while a transfer runs, without touching
+	its log; a sound change afterwards still goes through. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	leader.mu.Lock()
+	lastIndex := leader.lastLogIndex()
+	leader.mu.Unlock()
+
+	if err := leader.ChangeConfiguration(nil); err == nil {
+		t.Errorf("ChangeConfiguration accepted no voters")
+	}
+	if err := leader.ChangeConfiguration([]int{0, 1, 1}); err == nil {
+		t.Errorf("ChangeConfiguration accepted a voter twice")
+	}
+	leader.mu.Lock()
+	leader.leadTransferee = (leaderId + 1) % 3
+	leader.mu.Unlock()
+	if err := leader.ChangeConfiguration([]int{0, 1, 2}); err != ErrTransferInProgress {
+		t.Errorf("ChangeConfiguration during a transfer returned err=%v; want %v", err, ErrTransferInProgress)
+	}
+	leader.mu.Lock()
+	leader.leadTransferee = -1
+	if leader.lastLogIndex() != lastIndex {
+		t.Errorf("refused configuration changes were appended to the log")
+	}
+	leader.mu.Unlock()
+
+	if err := leader.ChangeConfiguration([]int{0, 1, 2}); err != nil {
+		t.Fatalf("ChangeConfiguration failed: %v", err)
+	}
+	cluster.waitForConfiguration(leaderId, []int{0, 1, 2})
+}
+
+func Test33(t *testing.T) {
+	/* Lease Vote Scenario: a follower grants a candidate's PreVote after losing
+	touch with the leader, then hears from the leader again, which renews its
+	lease through it; the candidate's real vote request that follows must be
+	ignored, term and all, so the lease stays safe. A vote for the target of
+	a leadership transfer is still granted. */
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	cluster.SubmitClientCommand(leaderId, "Set X = 1")
+	sleepMs(2000) // So the candidate's log, taken from the voter's below, is as up to date as anyone's
+	voterId, candidateId := (leaderId+1)%5, (leaderId+2)%5
+	voter := cluster.nodes[voterId].raftLogic
+
+	voter.mu.Lock()
+	term, lastIndex, lastTerm := voter.currentTerm, voter.lastLogIndex(), voter.lastLogTerm()
+	voter.lastLeaderContact = time.Time{} // As if the leader had gone quiet for an election timeout
+	voter.mu.Unlock()
+	var preVote PreVoteReply
+	voter.HandlePreVote(PreVoteArgs{Term: term + 1, CandidateId: candidateId, LastLogIndex: lastIndex, LastLogTerm: lastTerm}, &preVote)
+	if !preVote.VoteGranted {
+		t.Fatalf("follower that lost touch with the leader refused a PreVote: %+v", preVote)
+	}
+
+	sleepMs(2000) // The leader's heartbeats reach the voter again, and renew the lease
+	if _, err := leader.LeaseRead("Set X"); err != nil {
+		t.Fatalf("leader has no lease: %v", err)
+	}
+
+	vote := RequestVoteArgs{Term: term + 1, CandidateId: candidateId, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	var reply RequestVoteReply
+	voter.HandleRequestVote(vote, &reply)
+	if _, voterTerm, _ := voter.GetNodeState(); reply.VoteGranted || voterTerm != term {
+		t.Errorf("follower hearing from the leader answered a vote with %+v and moved to term %d; want it ignored in term %d", reply, voterTerm, term)
+	}
+	if _, err := leader.LeaseRead("Set X"); err != nil {
+		t.Errorf("leader lost its lease to an ignored vote: %v", err)
+	}
+
+	vote.LeadershipTransfer = true
+	voter.HandleRequestVote(vote, &reply)
+	if !reply.VoteGranted {
+		t.Errorf("follower refused a vote for the target of a leadership transfer: %+v", reply)
+	}
+}
+
+func Test34(t *testing.T) {
+	/* Snapshot Behind Sessions Scenario: the application snapshots at an index
+	the apply loop has already moved past with later commands in a session;
+	the log is still compacted, and the snapshot carries the sessions as they
+	were at its index rather than as they are now. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+
+	indexes := make([]int, 0)
+	for sequence := int64(1); sequence <= 3; sequence++ {
+		index, _, _, future := leader.ProposeInSession(7, sequence, fmt.Sprintf("Set X = %d", sequence))
+		if _, err := waitForCommit(future); err != nil {
+			t.Fatalf("request %d failed: %v", sequence, err)
+		}
+		indexes = append(indexes, index)
+	}
+
+	leader.Snapshot(indexes[1], []byte("X = 2"))
+
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	if leader.lastIncludedIndex != indexes[1] {
+		t.Errorf("snapshot at %d left lastIncludedIndex=%d", indexes[1], leader.lastIncludedIndex)
+	}
+	if session := leader.lastIncludedSessions[7]; session.Sequence != 2 || session.Index != indexes[1] {
+		t.Errorf("snapshot at %d holds session %+v; want sequence 2", indexes[1], session)
+	}
+	if session := leader.sessions[7]; session.Sequence != 3 {
+		t.Errorf("taking a snapshot moved the live session back to %+v", session)
+	}
+}
+
+func Test35(t *testing.T) {
+	/* Timed-out Transfer Scenario: the target of a leadership transfer is sent
+	TimeoutNow, but nothing it sends gets through, so the transfer times out;
+	the leader carries on, yet serves no lease reads until an election timeout
+	has passed, since the target's election could have won votes that ignore
+	the lease. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	leader := cluster.nodes[leaderId].raftLogic
+	cluster.SubmitClientCommand(leaderId, "Set X = 1")
+	sleepMs(2000) // So the target is caught up, and the transfer sends it TimeoutNow
+	targetId := (leaderId + 1) % 3
+	if _, err := leader.LeaseRead("Set X"); err != nil {
+		t.Fatalf("leader has no lease: %v", err)
+	}
+
+	cluster.CutLink(targetId, leaderId)
+	cluster.CutLink(targetId, (leaderId+2)%3)
+	if err := leader.TransferLeadership(targetId); err != ErrTransferTimeout {
+		t.Fatalf("transfer to a target nobody hears from returned err=%v; want %v", err, ErrTransferTimeout)
+	}
+	if _, _, isLeader := leader.GetNodeState(); !isLeader {
+		t.Fatalf("leader stepped down after a transfer that timed out")
+	}
+	if _, err := leader.LeaseRead("Set X"); err != ErrLeaseExpired {
+		t.Errorf("lease read right after TimeoutNow was sent returned err=%v; want %v", err, ErrLeaseExpired)
+	}
+
+	sleepMs(3500)
+	if _, err := leader.LeaseRead("Set X"); err != nil {
+		t.Errorf("leader has no lease an election timeout after the transfer: %v", err)
+	}
+}
+
+func Test36(t *testing.T) {
+	/* Mid-Batch Snapshot Scenario: the application snapshots at each command
+	as soon as it receives it on applyCh, while later commands of the same
+	batch still wait to be received; the snapshot is taken, and the log
+	compacted, rather than refused as ahead of lastApplied. Killing the node
+	then closes applyCh. */
+
+	config := DefaultConfig()
+	config.ElectionTimeoutMin = 300 * time.Millisecond
+	config.ElectionTimeoutMax = 600 * time.Millisecond
+	config.HeartbeatInterval = 100 * time.Millisecond
+	config.TickInterval = 50 * time.Millisecond
+	config.MaxClockDrift = 30 * time.Millisecond
+
+	applyCh := make(chan ApplyMsg)
+	ready := make(chan interface{})
+	close(ready)
+	node, err := NewRaftNode(0, []int{}, NewMemoryNetwork().NewTransport(), config, NewMemoryPersister(), nil, applyCh, ready)
+	if err != nil {
+		t.Fatalf("NewRaftNode failed: %v", err)
+	}
+
+	for r := 0; r < 20; r++ {
+		if _, _, isLeader := node.GetNodeState(); isLeader {
+			break
+		}
+		sleepMs(100)
+	}
+	if _, _, isLeader, _ := node.Propose("Set X = 1"); !isLeader {
+		t.Fatalf("single node did not become leader")
+	}
+	sleepMs(200) // The apply loop now waits for the first command to be received, alone in its batch
+	node.Propose("Set X = 2")
+	node.Propose("Set X = 3")
+	sleepMs(200)
+
+	for i := 0; i < 3; i++ {
+		msg := <-applyCh
+		node.Snapshot(msg.CommandIndex, []byte(fmt.Sprintf("X = %d", i+1)))
+
+		node.mu.Lock()
+		if node.lastIncludedIndex != msg.CommandIndex {
+			t.Errorf("snapshot at %d, just received, left lastIncludedIndex=%d", msg.CommandIndex, node.lastIncludedIndex)
+		}
+		node.mu.Unlock()
+	}
+
+	node.KillNode()
+	select {
+	case msg, ok := <-applyCh:
+		if ok {
+			t.Errorf("killed node sent %+v on applyCh", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("killed node left applyCh open")
+	}
+}
+
+func Test37(t *testing.T) {
+	/* Stalled Apply Scenario: a leader whose applyCh consumer stops receiving
+	cannot apply what it commits; a lease read waiting on those entries gives
+	up after an election timeout instead of hanging. */
+
+	config := DefaultConfig()
+	config.ElectionTimeoutMin = 300 * time.Millisecond
+	config.ElectionTimeoutMax = 600 * time.Millisecond
+	config.HeartbeatInterval = 100 * time.Millisecond
+	config.TickInterval = 50 * time.Millisecond
+	config.MaxClockDrift = 30 * time.Millisecond
+
+	applyCh := make(chan ApplyMsg) // Never received from
+	ready := make(chan interface{})
+	close(ready)
+	stateMachine := NewFileStateMachine(t.TempDir() + "/log")
+	node, err := NewRaftNode(0, []int{}, NewMemoryNetwork().NewTransport(), config, NewMemoryPersister(), stateMachine, applyCh, ready)
+	if err != nil {
+		t.Fatalf("NewRaftNode failed: %v", err)
+	}
+	defer node.KillNode()
+
+	for r := 0; r < 20; r++ {
+		if _, _, isLeader := node.GetNodeState(); isLeader {
+			break
+		}
+		sleepMs(100)
+	}
+	node.Propose("Set X = 1")
+	node.Propose("Set X = 2")
+	sleepMs(200) // The apply loop is stuck sending the first command, with the second committed behind it
+
+	start := time.Now()
+	if _, err := node.LeaseRead("Set X"); err != ErrReadTimeout {
+		t.Errorf("lease read behind a stalled apply loop returned err=%v; want %v", err, ErrReadTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 2*config.ElectionTimeoutMin {
+		t.Errorf("lease read took %v to give up; want about %v", elapsed, config.ElectionTimeoutMin)
+	}
+}
+
+func Test38(t *testing.T) {
+	/* Steady Follower Scenario: a follower told again to follow in the term it
+	is already in keeps the RPCs it has outstanding, such as a forwarded
+	command; only moving to a new term gives up on them. */
+
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+
+	leaderId := cluster.getClusterLeader()
+	follower := cluster.nodes[(leaderId+1)%3].raftLogic
+
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	ctx, term := follower.stateCtx, follower.currentTerm
+	follower.becomeFollower(term)
+	if ctx.Err() != nil {
+		t.Errorf("following again in term %d cancelled the follower's RPCs", term)
+	}
+	follower.becomeFollower(term + 1)
+	if ctx.Err() == nil {
+		t.Errorf("moving to term %d kept the follower's RPCs from term %d going", term+1, term)
+	}
+}
@@ -0,0 +1,538 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport carries the RPCs between the servers of a cluster. A RaftNode reaches its peers by id
+// through Call; the Server it runs in hands the transport the receiver of incoming RPCs through Serve.
+type Transport interface {
+	// Serve starts delivering the "RaftNode.<Method>" RPCs sent to Addr to handler, whose
+	// methods have the net/rpc form func(args T, reply *R) error.
+	Serve(handler interface{}) error
+
+	// Addr is where peers Connect to reach this transport, once it is serving.
+	Addr() string
+
+	// Connect lets Call reach peerId at addr; Disconnect and DisconnectAll undo it.
+	Connect(peerId int, addr string) error
+	Disconnect(peerId int) error
+	DisconnectAll()
+
+	// Call invokes serviceMethod on peerId with args and waits for its reply, or returns ctx.Err()
+	// once ctx is done. reply must not be looked at after an error.
+	Call(ctx context.Context, peerId int, serviceMethod string, args interface{}, reply interface{}) error
+
+	// PeerStatus reports the state of the connection to each peer it was told to Connect to.
+	PeerStatus() map[int]PeerStatus
+
+	// Close stops serving and drops every connection.
+	Close() error
+}
+
+// PeerStatus is what a Transport knows of its connection to one peer.
+type PeerStatus struct {
+	Addr string
+
+	// "Connected"; "Reconnecting" while the connection is down and the transport is redialing Addr;
+	// or "Down" when it is down for good, such as when the peer closed its in-memory transport.
+	State string
+
+	FailedDials int // Since the peer was last connected
+}
+
+/* TCP Transport, net/rpc over one connection to each peer.
+Once a connection breaks, the calls made on it fail and the transport redials the peer's address in
+the background, backing off exponentially with jitter between failed dials, until it connects again
+or the peer is Disconnected. Calls made in the meantime fail straight away. */
+
+type TCPTransport struct {
+	mu sync.Mutex
+
+	listenAddr string
+
+	RPCServer *rpc.Server
+	listener  net.Listener
+
+	peers map[int]*tcpPeer
+
+	// Bounds on the wait between two dials of a broken peer; set them before calling Connect
+	RedialBackoffMin time.Duration
+	RedialBackoffMax time.Duration
+
+	quit chan interface{}
+	wg   sync.WaitGroup
+}
+
+// tcpPeer is a peer we have been told to Connect to. Fields are guarded by the transport's mu.
+type tcpPeer struct {
+	addr      string
+	client    *rpc.Client // nil while the connection is down
+	redialing bool
+	failures  int              // Dials that failed since we were last connected
+	stop      chan interface{} // Closed once the peer is Disconnected, to end redialing
+}
+
+// NewTCPTransport returns a transport that will listen on listenAddr, ":0" for any free port.
+func NewTCPTransport(listenAddr string) *TCPTransport {
+	this := new(TCPTransport)
+	this.listenAddr = listenAddr
+	this.peers = make(map[int]*tcpPeer)
+	this.RedialBackoffMin = 50 * time.Millisecond
+	this.RedialBackoffMax = 5 * time.Second
+	this.quit = make(chan interface{})
+	return this
+}
+
+func (this *TCPTransport) Serve(handler interface{}) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// Create a new RPC server
+	this.RPCServer = rpc.NewServer()
+	if err := this.RPCServer.RegisterName("RaftNode", handler); err != nil {
+		return err
+	}
+
+	var err error
+	if this.listener, err = net.Listen("tcp", this.listenAddr); err != nil {
+		return err
+	}
+
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+
+		for {
+			conn, err := this.listener.Accept()
+			if err != nil {
+				select {
+				case <-this.quit:
+					return
+				default:
+					log.Fatal("accept error:", err)
+				}
+			}
+			this.wg.Add(1)
+			go func() {
+				this.RPCServer.ServeConn(conn)
+				this.wg.Done()
+			}()
+		}
+	}()
+	return nil
+}
+
+func (this *TCPTransport) Addr() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.listener.Addr().String()
+}
+
+// Connect dials peerId at addr. If that fails, the transport keeps redialing addr in the background.
+func (this *TCPTransport) Connect(peerId int, addr string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	peer := this.peers[peerId]
+	if peer == nil {
+		peer = &tcpPeer{stop: make(chan interface{})}
+		this.peers[peerId] = peer
+	} else if peer.client != nil {
+		return nil
+	}
+	peer.addr = addr
+
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		peer.failures++
+		this.startRedialing(peerId, peer)
+		return err
+	}
+	peer.client, peer.failures = client, 0
+	return nil
+}
+
+func (this *TCPTransport) Disconnect(peerId int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if peer := this.peers[peerId]; peer != nil {
+		delete(this.peers, peerId)
+		close(peer.stop)
+		if peer.client != nil {
+			return peer.client.Close()
+		}
+	}
+	return nil
+}
+
+func (this *TCPTransport) DisconnectAll() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for peerId, peer := range this.peers {
+		delete(this.peers, peerId)
+		close(peer.stop)
+		if peer.client != nil {
+			peer.client.Close()
+		}
+	}
+}
+
+func (this *TCPTransport) Call(ctx context.Context, peerId int, serviceMethod string, args interface{}, reply interface{}) error {
+	this.mu.Lock()
+	peer := this.peers[peerId]
+	var client *rpc.Client
+	if peer != nil {
+		client = peer.client
+	}
+	this.mu.Unlock()
+
+	if peer == nil {
+		return fmt.Errorf("call client %d after it's closed", peerId)
+	} else if client == nil {
+		return fmt.Errorf("call client %d while reconnecting to it", peerId)
+	}
+
+	// A reply that arrives after we gave up is decoded into reply and dropped
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if connectionBroken(call.Error) {
+			this.mu.Lock()
+			if this.peers[peerId] == peer && peer.client == client { // Neither Disconnected nor already redialed
+				log.Printf("connection to peer %d at %s broke: %v; reconnecting", peerId, peer.addr, call.Error)
+				client.Close()
+				peer.client = nil
+				this.startRedialing(peerId, peer)
+			}
+			this.mu.Unlock()
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connectionBroken tells a call that failed because its connection is gone from one the peer answered with an error.
+func connectionBroken(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// startRedialing redials peer in the background, unless that is already happening. Called with this.mu held.
+func (this *TCPTransport) startRedialing(peerId int, peer *tcpPeer) {
+	if peer.redialing {
+		return
+	}
+	peer.redialing = true
+	this.wg.Add(1)
+	go this.redial(peerId, peer)
+}
+
+/* redial dials peer until it connects, the peer is Disconnected or the transport closes. The wait
+after the n-th failed dial is drawn from [b/2, b), where b is RedialBackoffMin doubled n-1 times,
+up to RedialBackoffMax, so peers that lost the same server do not all come knocking at once. */
+func (this *TCPTransport) redial(peerId int, peer *tcpPeer) {
+	defer this.wg.Done()
+	backoff := this.RedialBackoffMin
+	for {
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-peer.stop:
+			return
+		case <-this.quit:
+			return
+		}
+
+		this.mu.Lock()
+		addr := peer.addr
+		this.mu.Unlock()
+		client, err := rpc.Dial("tcp", addr)
+
+		this.mu.Lock()
+		if this.peers[peerId] != peer { // Disconnected while we were dialing
+			this.mu.Unlock()
+			if client != nil {
+				client.Close()
+			}
+			return
+		}
+		if peer.client != nil { // Connect got there first
+			peer.redialing = false
+			this.mu.Unlock()
+			if client != nil {
+				client.Close()
+			}
+			return
+		}
+		if err == nil {
+			log.Printf("reconnected to peer %d at %s after %d failed dials", peerId, addr, peer.failures)
+			peer.client, peer.failures, peer.redialing = client, 0, false
+			this.mu.Unlock()
+			return
+		}
+		peer.failures++
+		this.mu.Unlock()
+
+		if backoff *= 2; backoff > this.RedialBackoffMax {
+			backoff = this.RedialBackoffMax
+		}
+	}
+}
+
+func (this *TCPTransport) PeerStatus() map[int]PeerStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	status := make(map[int]PeerStatus, len(this.peers))
+	for peerId, peer := range this.peers {
+		state := "Connected"
+		if peer.client == nil {
+			state = "Reconnecting"
+		}
+		status[peerId] = PeerStatus{Addr: peer.addr, State: state, FailedDials: peer.failures}
+	}
+	return status
+}
+
+// Close waits for the connections peers opened to us to be closed by them.
+func (this *TCPTransport) Close() error {
+	this.DisconnectAll()
+	close(this.quit)
+	err := this.listener.Close()
+	this.wg.Wait()
+	return err
+}
+
+/* In-memory Transport, for running a whole cluster inside one process without sockets.
+Requests and replies are gob-encoded just as net/rpc would, so a handler never shares memory with
+its caller, and travel over channels. As with a closed TCP connection, the caller's Disconnect or
+either end's Close fails the calls that are still waiting for a reply. */
+
+// A MemoryNetwork is the address space MemoryTransports listen on and connect through.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	endpoints map[string]*MemoryTransport
+	nextAddr  int
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	this := new(MemoryNetwork)
+	this.endpoints = make(map[string]*MemoryTransport)
+	return this
+}
+
+// NewTransport returns a transport with an address of its own on the network.
+func (this *MemoryNetwork) NewTransport() *MemoryTransport {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	transport := new(MemoryTransport)
+	transport.network = this
+	transport.addr = "mem:" + strconv.Itoa(this.nextAddr)
+	transport.requests = make(chan *memoryRequest)
+	transport.peers = make(map[int]*memoryConn)
+	transport.quit = make(chan interface{})
+	this.nextAddr++
+	return transport
+}
+
+type MemoryTransport struct {
+	mu      sync.Mutex
+	network *MemoryNetwork
+	addr    string
+
+	requests chan *memoryRequest // Incoming calls, each handled on its own goroutine
+	peers    map[int]*memoryConn
+	quit     chan interface{}
+}
+
+type memoryConn struct {
+	remote *MemoryTransport
+	closed chan interface{}
+}
+
+type memoryRequest struct {
+	serviceMethod string
+	args          []byte
+	response      chan memoryResponse // Buffered, so a handler finishing after its caller gave up never blocks
+}
+
+type memoryResponse struct {
+	reply []byte
+	err   error
+}
+
+func (this *MemoryTransport) Serve(handler interface{}) error {
+	this.network.mu.Lock()
+	this.network.endpoints[this.addr] = this
+	this.network.mu.Unlock()
+
+	receiver := reflect.ValueOf(handler)
+	go func() {
+		for {
+			select {
+			case request := <-this.requests:
+				go func() {
+					var response memoryResponse
+					response.reply, response.err = dispatch(receiver, request.serviceMethod, request.args)
+					request.response <- response
+				}()
+			case <-this.quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (this *MemoryTransport) Addr() string {
+	return this.addr
+}
+
+func (this *MemoryTransport) Connect(peerId int, addr string) error {
+	this.network.mu.Lock()
+	remote := this.network.endpoints[addr]
+	this.network.mu.Unlock()
+	if remote == nil {
+		return fmt.Errorf("dial %s: no transport serving there", addr)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.peers[peerId] == nil {
+		this.peers[peerId] = &memoryConn{remote: remote, closed: make(chan interface{})}
+	}
+	return nil
+}
+
+func (this *MemoryTransport) Disconnect(peerId int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if conn := this.peers[peerId]; conn != nil {
+		close(conn.closed)
+		delete(this.peers, peerId)
+	}
+	return nil
+}
+
+func (this *MemoryTransport) DisconnectAll() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for peerId, conn := range this.peers {
+		close(conn.closed)
+		delete(this.peers, peerId)
+	}
+}
+
+func (this *MemoryTransport) Call(ctx context.Context, peerId int, serviceMethod string, args interface{}, reply interface{}) error {
+	this.mu.Lock()
+	conn := this.peers[peerId]
+	this.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("call client %d after it's closed", peerId)
+	}
+
+	encodedArgs, err := gobEncode(args)
+	if err != nil {
+		return err
+	}
+	request := &memoryRequest{serviceMethod: serviceMethod, args: encodedArgs, response: make(chan memoryResponse, 1)}
+
+	select {
+	case conn.remote.requests <- request:
+	case <-conn.closed:
+		return rpc.ErrShutdown
+	case <-conn.remote.quit:
+		return rpc.ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case response := <-request.response:
+		if response.err != nil {
+			return response.err
+		}
+		return gob.NewDecoder(bytes.NewReader(response.reply)).Decode(reply)
+	case <-conn.closed:
+		return rpc.ErrShutdown
+	case <-conn.remote.quit:
+		return rpc.ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *MemoryTransport) PeerStatus() map[int]PeerStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	status := make(map[int]PeerStatus, len(this.peers))
+	for peerId, conn := range this.peers {
+		state := "Connected"
+		select {
+		case <-conn.remote.quit:
+			state = "Down"
+		default:
+		}
+		status[peerId] = PeerStatus{Addr: conn.remote.addr, State: state}
+	}
+	return status
+}
+
+func (this *MemoryTransport) Close() error {
+	this.network.mu.Lock()
+	if this.network.endpoints[this.addr] == this {
+		delete(this.network.endpoints, this.addr)
+	}
+	this.network.mu.Unlock()
+
+	this.DisconnectAll()
+	close(this.quit)
+	return nil
+}
+
+// dispatch decodes args for the handler method serviceMethod names, calls it and encodes its reply.
+func dispatch(receiver reflect.Value, serviceMethod string, args []byte) ([]byte, error) {
+	service, methodName, found := strings.Cut(serviceMethod, ".")
+	if !found || service != "RaftNode" {
+		return nil, rpc.ServerError("rpc: can't find service " + serviceMethod)
+	}
+	method := receiver.MethodByName(methodName)
+	if !method.IsValid() || method.Type().NumIn() != 2 || method.Type().NumOut() != 1 || method.Type().In(1).Kind() != reflect.Pointer {
+		return nil, rpc.ServerError("rpc: can't find method " + serviceMethod)
+	}
+
+	argsValue := reflect.New(method.Type().In(0))
+	if err := gob.NewDecoder(bytes.NewReader(args)).Decode(argsValue.Interface()); err != nil {
+		return nil, err
+	}
+	replyValue := reflect.New(method.Type().In(1).Elem())
+
+	if err, _ := method.Call([]reflect.Value{argsValue.Elem(), replyValue})[0].Interface().(error); err != nil {
+		return nil, rpc.ServerError(err.Error())
+	}
+	return gobEncode(replyValue.Interface())
+}
+
+func gobEncode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -1,10 +1,7 @@
 package raft
 
 import (
-	"fmt"
 	"log"
-	"net"
-	"net/rpc"
 	"sync"
 )
 
@@ -15,148 +12,110 @@ type Server struct {
 	serverId int
 	peersIds []int
 
-	RPCServer *rpc.Server
-	listener  net.Listener
-
-	peerClients map[int]*rpc.Client
+	transport Transport
 
 	ready <-chan interface{}
-	quit  chan interface{}
-	wg    sync.WaitGroup
 
-	raftLogic     *RaftNode // Added in RaftLogic component
-	minRPCLatency int
+	raftLogic *RaftNode // Added in RaftLogic component
+	config    Config
+
+	persister    Persister
+	stateMachine StateMachine
+	applyCh      chan<- ApplyMsg
 }
 
-func NewServer(serverId int, peersIds []int, ready <-chan interface{}, minRPCLatency int) *Server {
+// NewServer sets up a server that runs a RaftNode with config, which must be valid, and talks to its peers over transport.
+func NewServer(serverId int, peersIds []int, ready <-chan interface{}, config Config, transport Transport, persister Persister, stateMachine StateMachine, applyCh chan<- ApplyMsg) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	this := new(Server)
 
 	this.serverId = serverId
 	this.peersIds = peersIds
-	this.peerClients = make(map[int]*rpc.Client)
+	this.transport = transport
 
 	this.ready = ready
-	this.quit = make(chan interface{})
 
-	this.minRPCLatency = minRPCLatency
+	this.config = config
+	this.persister = persister
+	this.stateMachine = stateMachine
+	this.applyCh = applyCh
 
-	return this
+	return this, nil
 }
 
 func (this *Server) Serve() {
 	this.mu.Lock()
+	defer this.mu.Unlock()
 
 	// Add in logic component
-	this.raftLogic = NewRaftNode(this.serverId, this.peersIds, this, this.ready)
-
-	// Create a new RPC server
-	this.RPCServer = rpc.NewServer()
-	this.RPCServer.RegisterName("RaftNode", this)
-
 	var err error
-	if this.listener, err = net.Listen("tcp", ":0"); err != nil {
+	if this.raftLogic, err = NewRaftNode(this.serverId, this.peersIds, this.transport, this.config, this.persister, this.stateMachine, this.applyCh, this.ready); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("[%v] listening at %v", this.serverId, this.listener.Addr())
-	this.mu.Unlock()
-
-	this.wg.Add(1)
-	go func() {
-		defer this.wg.Done()
-
-		for {
-			conn, err := this.listener.Accept()
-			if err != nil {
-				select {
-				case <-this.quit:
-					return
-				default:
-					log.Fatal("accept error:", err)
-				}
-			}
-			this.wg.Add(1)
-			go func() {
-				this.RPCServer.ServeConn(conn)
-				this.wg.Done()
-			}()
-		}
-	}()
-
-}
-
-func (this *Server) GetCurrentAddress() net.Addr {
-	this.mu.Lock()
-	defer this.mu.Unlock()
-	return this.listener.Addr()
-}
+	if err := this.transport.Serve(this); err != nil {
+		log.Fatal(err)
+	}
 
-func (this *Server) SendRPCCallTo(id int, serviceMethod string, args interface{}, reply interface{}) error {
-	this.mu.Lock()
-	peer := this.peerClients[id]
-	this.mu.Unlock()
+	log.Printf("[%v] listening at %v", this.serverId, this.transport.Addr())
+}
 
-	if peer == nil {
-		return fmt.Errorf("call client %d after it'this closed", id)
-	} else {
-		return peer.Call(serviceMethod, args, reply)
-	}
+func (this *Server) GetCurrentAddress() string {
+	return this.transport.Addr()
 }
 
 func (this *Server) Shutdown() {
 	this.raftLogic.KillNode() // Make sure heartbeats and requests stop
-	close(this.quit)
-	this.listener.Close()
-	this.wg.Wait()
+	this.transport.Close()
 }
 
 /* Functions that facilitate peer to peer connection/disconnection */
 
-func (this *Server) ConnectToPeer(peerId int, addr net.Addr) error {
-	this.mu.Lock()
-	defer this.mu.Unlock()
-	if this.peerClients[peerId] == nil {
-		client, err := rpc.Dial(addr.Network(), addr.String())
-		if err != nil {
-			return err
-		}
-		this.peerClients[peerId] = client
-	}
-	return nil
+func (this *Server) ConnectToPeer(peerId int, addr string) error {
+	return this.transport.Connect(peerId, addr)
 }
 
 func (this *Server) DisconnectPeer(peerId int) error {
-	this.mu.Lock()
-	defer this.mu.Unlock()
-	if this.peerClients[peerId] != nil {
-		err := this.peerClients[peerId].Close()
-		this.peerClients[peerId] = nil
-		return err
-	}
-	return nil
+	return this.transport.Disconnect(peerId)
 }
 
 func (this *Server) DisconnectAll() {
-	this.mu.Lock()
-	defer this.mu.Unlock()
-	for id := range this.peerClients {
-		if this.peerClients[id] != nil {
-			this.peerClients[id].Close()
-			this.peerClients[id] = nil
-		}
-	}
+	this.transport.DisconnectAll()
 }
 
-// Register Custom Methods here:
+// PeerStatus reports, for each peer this server was connected to, whether it still is.
+func (this *Server) PeerStatus() map[int]PeerStatus {
+	return this.transport.PeerStatus()
+}
 
-/* To actually add a delay for each request, a wrapper */
+// Register Custom Methods here:
 
 func (this *Server) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
-	sleepMs(this.minRPCLatency + args.Latency) // Add Latency
 	return this.raftLogic.HandleRequestVote(args, reply)
 }
 
+func (this *Server) PreVote(args PreVoteArgs, reply *PreVoteReply) error {
+	return this.raftLogic.HandlePreVote(args, reply)
+}
+
 func (this *Server) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	sleepMs(this.minRPCLatency + args.Latency) // Add Latency
 	return this.raftLogic.HandleAppendEntries(args, reply)
 }
+
+func (this *Server) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return this.raftLogic.HandleTimeoutNow(args, reply)
+}
+
+func (this *Server) ReadIndex(args ReadIndexArgs, reply *ReadIndexReply) error {
+	return this.raftLogic.HandleReadIndex(args, reply)
+}
+
+func (this *Server) ForwardCommand(args ForwardCommandArgs, reply *ForwardCommandReply) error {
+	return this.raftLogic.HandleForwardCommand(args, reply)
+}
+
+func (this *Server) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return this.raftLogic.HandleInstallSnapshot(args, reply)
+}